@@ -18,6 +18,13 @@ const (
 	urlFetchTimeout = 20 * time.Second
 )
 
+// The header field in which to tell meek-server the address of the client, so
+// that the client's country shows in tor's statistics. (App Engine doesn't let
+// us set X-Forwarded-For.) meek-server uses it only if run with
+// --client-addr-header=X-Meek-Client-Addr and with App Engine's addresses in
+// --trusted-proxy.
+const clientAddrHeader = "X-Meek-Client-Addr"
+
 var context appengine.Context
 
 // Join two URL paths.
@@ -37,10 +44,13 @@ func pathJoin(a, b string) string {
 // Transfer-Encoding that interfere with App Engine's own hop-by-hop headers.
 var reflectedHeaderFields = []string{
 	"X-Session-Id",
+	"X-Session-Seq",
+	"X-Session-Target",
 }
 
 // Make a copy of r, with the URL being changed to be relative to forwardURL,
-// and including only the headers in reflectedHeaderFields.
+// and including only the headers in reflectedHeaderFields, plus the client
+// address in clientAddrHeader.
 func copyRequest(r *http.Request) (*http.Request, error) {
 	u, err := url.Parse(forwardURL)
 	if err != nil {
@@ -59,6 +69,9 @@ func copyRequest(r *http.Request) (*http.Request, error) {
 			c.Header.Add(key, value)
 		}
 	}
+	if r.RemoteAddr != "" {
+		c.Header.Set(clientAddrHeader, r.RemoteAddr)
+	}
 	return c, nil
 }
 
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+
+// The code in this file has to do with the configuration file given by
+// --config, and with looking up per-connection options.
+//
+// The configuration file is JSON. It defines named profiles, each of which is a
+// set of per-connection options, exactly as they would appear as SOCKS args:
+// 	{
+// 		"profiles": {
+// 			"google": {
+// 				"url": "https://meek-reflect.appspot.com/",
+// 				"front": ["www.google.com", "mail.google.com"],
+// 				"headers": "firefox.txt",
+// 				"header": ["Accept-Language: en-US,en;q=0.5"]
+// 			}
+// 		}
+// 	}
+// A value may be a string or a list of strings. A list is joined with commas
+// for options that take a comma-separated list, and is a repeated option for
+// header. Relative filenames are relative to the directory of the configuration
+// file.
+//
+// A connection uses the profile named by its profile= SOCKS arg, or else the
+// one named by --profile. Each per-connection option is taken from the first
+// of these places that has it:
+// 	1. a SOCKS arg
+// 	2. the connection's profile
+// 	3. a command line option
+
+// The ways the value of a per-connection option can be given.
+type argKind int
+
+const (
+	// A single string.
+	argSingle argKind = iota
+	// A single string, naming a file.
+	argFilename
+	// A comma-separated list; in a profile, a list is joined with commas.
+	argList
+	// An option that may be repeated.
+	argRepeated
+)
+
+// All the per-connection options that may appear in a profile.
+var connArgKinds = map[string]argKind{
+	"ca":         argFilename,
+	"connect-to": argList,
+	"doh":        argSingle,
+	"ech":        argSingle,
+	"front":      argList,
+	"header":     argRepeated,
+	"headers":    argFilename,
+	"pin":        argList,
+	"proxy":      argSingle,
+	"resolve":    argList,
+	"url":        argList,
+
+	"init-poll-interval":       argSingle,
+	"max-poll-interval":        argSingle,
+	"poll-interval-multiplier": argSingle,
+	"max-tries":                argSingle,
+	"retry-delay":              argSingle,
+	"max-retry-delay":          argSingle,
+	"retry-deadline":           argSingle,
+}
+
+// Decode a profile option value, which may be a string or a list of strings.
+func decodeArgValue(key string, kind argKind, raw json.RawMessage) ([]string, error) {
+	var s string
+	err := json.Unmarshal(raw, &s)
+	if err == nil {
+		return []string{s}, nil
+	}
+	var list []string
+	err = json.Unmarshal(raw, &list)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s must be a string or a list of strings", key))
+	}
+	switch kind {
+	case argList:
+		return []string{strings.Join(list, ",")}, nil
+	case argRepeated:
+		return list, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("%s must be a string", key))
+	}
+}
+
+// Read a configuration file, returning its profiles.
+func loadConfig(filename string) (map[string]pt.Args, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Profiles map[string]map[string]json.RawMessage `json:"profiles"`
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", filename, err))
+	}
+
+	dir := filepath.Dir(filename)
+	profiles := make(map[string]pt.Args)
+	for name, rawArgs := range config.Profiles {
+		args := make(pt.Args)
+		for key, raw := range rawArgs {
+			kind, ok := connArgKinds[key]
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("%s: profile %q: unknown option %q", filename, name, key))
+			}
+			values, err := decodeArgValue(key, kind, raw)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: profile %q: %s", filename, name, err))
+			}
+			for _, value := range values {
+				if kind == argFilename && value != "" && !filepath.IsAbs(value) {
+					value = filepath.Join(dir, value)
+				}
+				args.Add(key, value)
+			}
+		}
+		profiles[name] = args
+	}
+	return profiles, nil
+}
+
+// Return the names of the profiles in sorted order.
+func profileNames(profiles map[string]pt.Args) []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The sources of per-connection options, other than the command line.
+type connArgs struct {
+	socks   pt.Args
+	profile pt.Args
+}
+
+// Look up a per-connection option in the SOCKS args, then the profile. If it is
+// not found there, return commandLine, with ok being true if commandLine is not
+// empty.
+func (args *connArgs) get(key, commandLine string) (value string, ok bool) {
+	value, ok = args.socks.Get(key)
+	if ok {
+		return value, true
+	}
+	value, ok = args.profile.Get(key)
+	if ok {
+		return value, true
+	}
+	return commandLine, commandLine != ""
+}
+
+// Like get, but return every value of a repeated option.
+func (args *connArgs) getAll(key string, commandLine []string) []string {
+	values, ok := args.socks[key]
+	if ok {
+		return values
+	}
+	values, ok = args.profile[key]
+	if ok {
+		return values
+	}
+	return commandLine
+}
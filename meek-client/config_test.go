@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+
+// Write contents to a temporary file and load it as a configuration file.
+func loadConfigString(t *testing.T, contents string) (map[string]pt.Args, error) {
+	f, err := ioutil.TempFile("", "meek-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte(contents))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(f.Name())
+}
+
+func TestLoadConfig(t *testing.T) {
+	badTests := [...]string{
+		``,
+		`[]`,
+		`{"profiles": []}`,
+		`{"profiles": {"a": {"bogus": "x"}}}`,
+		`{"profiles": {"a": {"url": 1}}}`,
+		`{"profiles": {"a": {"doh": ["x", "y"]}}}`,
+		`{"profiles": {"a": {"headers": ["x", "y"]}}}`,
+	}
+
+	for _, input := range badTests {
+		_, err := loadConfigString(t, input)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+
+	profiles, err := loadConfigString(t, `{
+		"profiles": {
+			"a": {
+				"url": "https://meek.example.com/",
+				"front": ["x.example", "y.example"],
+				"header": ["User-Agent: test", "Accept: */*"],
+				"headers": "headers.txt",
+				"ca": "/etc/ca.pem"
+			},
+			"b": {}
+		}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := profileNames(profiles)
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Fatalf("profile names %q", names)
+	}
+	a := profiles["a"]
+	expected := map[string][]string{
+		"url":     {"https://meek.example.com/"},
+		"front":   {"x.example,y.example"},
+		"header":  {"User-Agent: test", "Accept: */*"},
+		"headers": {filepath.Join(os.TempDir(), "headers.txt")},
+		"ca":      {"/etc/ca.pem"},
+	}
+	if len(a) != len(expected) {
+		t.Errorf("profile a is %q (expected %q)", a, expected)
+	}
+	for key, values := range expected {
+		if len(a[key]) != len(values) {
+			t.Errorf("profile a has %s=%q (expected %q)", key, a[key], values)
+			continue
+		}
+		for i := range values {
+			if a[key][i] != values[i] {
+				t.Errorf("profile a has %s=%q (expected %q)", key, a[key], values)
+				break
+			}
+		}
+	}
+}
+
+func TestConnArgsPrecedence(t *testing.T) {
+	socks := pt.Args{}
+	socks.Add("url", "socks")
+	socks.Add("header", "A: socks")
+	profile := pt.Args{}
+	profile.Add("url", "profile")
+	profile.Add("front", "profile")
+	profile.Add("header", "A: profile")
+	profile.Add("header", "B: profile")
+	args := connArgs{socks: socks, profile: profile}
+
+	tests := [...]struct {
+		key, commandLine string
+		value            string
+		ok               bool
+	}{
+		{"url", "command line", "socks", true},
+		{"front", "command line", "profile", true},
+		{"proxy", "command line", "command line", true},
+		{"proxy", "", "", false},
+	}
+	for _, test := range tests {
+		value, ok := args.get(test.key, test.commandLine)
+		if value != test.value || ok != test.ok {
+			t.Errorf("%q %q → %q %v (expected %q %v)", test.key, test.commandLine, value, ok, test.value, test.ok)
+		}
+	}
+
+	if values := args.getAll("header", []string{"C: command line"}); len(values) != 1 || values[0] != "A: socks" {
+		t.Errorf("header → %q", values)
+	}
+	args.socks = nil
+	if values := args.getAll("header", []string{"C: command line"}); len(values) != 2 || values[1] != "B: profile" {
+		t.Errorf("header → %q", values)
+	}
+	args.profile = nil
+	if values := args.getAll("header", []string{"C: command line"}); len(values) != 1 || values[0] != "C: command line" {
+		t.Errorf("header → %q", values)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The code in this file has to do with finding the addresses to connect to for
+// a front, without necessarily trusting the system resolver. Addresses may
+// come from (in order of preference) a connect-to map of host names to
+// addresses that may also change the port, a static map of host names to
+// addresses, a DNS-over-HTTPS resolver (RFC 8484), or finally the system
+// resolver. Only the TCP connection is affected; the TLS SNI and certificate
+// verification still use the front name.
+
+const (
+	dnsTypeA     = 1
+	dnsTypeAAAA  = 28
+	dnsTypeHTTPS = 65
+	dnsClassIN   = 1
+	// Upper limit on a DoH response body.
+	maxDoHResponseLength = 65535
+	// Timeout for one DoH roundtrip.
+	dohTimeout = 10 * time.Second
+	// Timeout for each TCP connection attempt.
+	dialTimeout = 30 * time.Second
+)
+
+// A resource record from the answer section of a DNS response.
+type dnsRR struct {
+	Type uint16
+	TTL  uint32
+	Data []byte
+}
+
+// Encode a DNS query for name with the given type. The ID is 0, as recommended
+// for DoH.
+func dnsQuery(name string, qtype uint16) ([]byte, error) {
+	var buf bytes.Buffer
+	// ID 0, flags RD, 1 question.
+	buf.Write([]byte{0, 0, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0})
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil, errors.New("empty name")
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.New(fmt.Sprintf("bad label in name %q", name))
+		}
+		buf.WriteByte(byte(len(label)))
+		buf.WriteString(label)
+	}
+	buf.WriteByte(0)
+	binary.Write(&buf, binary.BigEndian, qtype)
+	binary.Write(&buf, binary.BigEndian, uint16(dnsClassIN))
+	return buf.Bytes(), nil
+}
+
+// Skip over a possibly compressed name starting at msg[off], returning the
+// offset just past it.
+func dnsSkipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n := int(msg[off])
+		switch n & 0xc0 {
+		case 0x00:
+			off++
+			if n == 0 {
+				return off, nil
+			}
+			off += n
+		case 0xc0:
+			// A compression pointer ends the name.
+			if off+2 > len(msg) {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return off + 2, nil
+		default:
+			return 0, errors.New("bad label type")
+		}
+	}
+}
+
+// Parse a DNS response, returning the records in its answer section. Returns
+// an error if the response code is not NOERROR.
+func dnsAnswers(msg []byte) ([]dnsRR, error) {
+	if len(msg) < 12 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if msg[2]&0x80 == 0 {
+		return nil, errors.New("DNS message is not a response")
+	}
+	if rcode := msg[3] & 0x0f; rcode != 0 {
+		return nil, errors.New(fmt.Sprintf("DNS response code %d", rcode))
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:8]))
+	off := 12
+	var err error
+	for i := 0; i < qdcount; i++ {
+		off, err = dnsSkipName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		// Type and class.
+		off += 4
+	}
+	var rrs []dnsRR
+	for i := 0; i < ancount; i++ {
+		off, err = dnsSkipName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		var rr dnsRR
+		rr.Type = binary.BigEndian.Uint16(msg[off : off+2])
+		rr.TTL = binary.BigEndian.Uint32(msg[off+4 : off+8])
+		rdlength := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10
+		if off+rdlength > len(msg) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		rr.Data = msg[off : off+rdlength]
+		off += rdlength
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// Parse a comma-separated list of HOST:ADDRESS entries into a map from host
+// names to addresses. An IPv6 address must be in brackets. A host may appear
+// more than once to give it more than one address.
+func parseResolveMap(s string) (map[string][]string, error) {
+	m := make(map[string][]string)
+	for _, elem := range splitList(s) {
+		i := strings.Index(elem, ":")
+		if i < 0 {
+			return nil, errors.New(fmt.Sprintf("resolve entry %q is not HOST:ADDRESS", elem))
+		}
+		host := strings.ToLower(elem[:i])
+		addr := strings.TrimSuffix(strings.TrimPrefix(elem[i+1:], "["), "]")
+		if host == "" || net.ParseIP(addr) == nil {
+			return nil, errors.New(fmt.Sprintf("resolve entry %q is not HOST:ADDRESS", elem))
+		}
+		m[host] = append(m[host], addr)
+	}
+	return m, nil
+}
+
+// Parse a comma-separated list of HOST:ADDRESS entries, where each ADDRESS is
+// an IP address, optionally with a port (an IPv6 address with a port must be in
+// brackets), into a map from host names to addresses with ports, the port being
+// empty where none was given. A host may appear more than once to give it more
+// than one address.
+func parseConnectTo(s string) (map[string][]string, error) {
+	m := make(map[string][]string)
+	for _, elem := range splitList(s) {
+		i := strings.Index(elem, ":")
+		if i < 0 {
+			return nil, errors.New(fmt.Sprintf("connect-to entry %q is not HOST:ADDRESS", elem))
+		}
+		host := strings.ToLower(elem[:i])
+		addr, port, err := net.SplitHostPort(elem[i+1:])
+		if err != nil {
+			addr, port = strings.TrimSuffix(strings.TrimPrefix(elem[i+1:], "["), "]"), ""
+		}
+		if host == "" || net.ParseIP(addr) == nil {
+			return nil, errors.New(fmt.Sprintf("connect-to entry %q is not HOST:ADDRESS", elem))
+		}
+		m[host] = append(m[host], net.JoinHostPort(addr, port))
+	}
+	return m, nil
+}
+
+// A Resolver controls how the host names in outgoing connections are turned
+// into addresses.
+type Resolver struct {
+	// Addresses to connect to instead of particular host names
+	// (lowercase), whatever they resolve to. An address with an empty port
+	// uses the port that was asked for.
+	ConnectTo map[string][]string
+	// Addresses to use for particular host names (lowercase).
+	Static map[string][]string
+	// URL of a DNS-over-HTTPS server. If nil, the system resolver is used
+	// for names not covered by ConnectTo or Static.
+	DoHURL *url.URL
+
+	cacheLock sync.Mutex
+	cache     map[string]cachedAddrs
+}
+
+type cachedAddrs struct {
+	addrs   []string
+	expires time.Time
+}
+
+// Make a Resolver from the connect-to, resolve, and doh options, any of which
+// may be empty. Returns nil if all are empty, meaning to use the system
+// resolver.
+func makeResolver(connectTo, resolve, doh string) (*Resolver, error) {
+	if connectTo == "" && resolve == "" && doh == "" {
+		return nil, nil
+	}
+	r := new(Resolver)
+	var err error
+	r.ConnectTo, err = parseConnectTo(connectTo)
+	if err != nil {
+		return nil, err
+	}
+	r.Static, err = parseResolveMap(resolve)
+	if err != nil {
+		return nil, err
+	}
+	if doh != "" {
+		r.DoHURL, err = url.Parse(doh)
+		if err != nil {
+			return nil, err
+		}
+		if r.DoHURL.Scheme != "https" {
+			return nil, errors.New(fmt.Sprintf("DoH URL %q is not https", doh))
+		}
+	}
+	return r, nil
+}
+
+// Do one DoH roundtrip for name and qtype and return the answer records.
+func (r *Resolver) dohQuery(name string, qtype uint16) ([]dnsRR, error) {
+	query, err := dnsQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: new(http.Transport), Timeout: dohTimeout}
+	req, err := http.NewRequest("POST", r.DoHURL.String(), bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("DoH server returned status %d", resp.StatusCode))
+	}
+	msg, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDoHResponseLength))
+	if err != nil {
+		return nil, err
+	}
+	return dnsAnswers(msg)
+}
+
+// Look up the IPv4 and IPv6 addresses of name using DoH, caching the result
+// for the smallest TTL seen.
+func (r *Resolver) dohLookup(name string) ([]string, error) {
+	r.cacheLock.Lock()
+	cached, ok := r.cache[name]
+	r.cacheLock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.addrs, nil
+	}
+
+	var addrs []string
+	var minTTL uint32 = 0xffffffff
+	var lastErr error
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		rrs, err := r.dohQuery(name, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range rrs {
+			if rr.Type != qtype {
+				// Probably a CNAME.
+				continue
+			}
+			if (qtype == dnsTypeA && len(rr.Data) != net.IPv4len) || (qtype == dnsTypeAAAA && len(rr.Data) != net.IPv6len) {
+				continue
+			}
+			addrs = append(addrs, net.IP(rr.Data).String())
+			if rr.TTL < minTTL {
+				minTTL = rr.TTL
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no addresses found")
+		}
+		return nil, errors.New(fmt.Sprintf("DoH lookup of %s: %s", name, lastErr))
+	}
+
+	r.cacheLock.Lock()
+	if r.cache == nil {
+		r.cache = make(map[string]cachedAddrs)
+	}
+	r.cache[name] = cachedAddrs{addrs, time.Now().Add(time.Duration(minTTL) * time.Second)}
+	r.cacheLock.Unlock()
+	return addrs, nil
+}
+
+// Return the list of addresses (each with a port) to try when asked to
+// connect to addr.
+func (r *Resolver) resolve(addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	if connectTo, ok := r.ConnectTo[strings.ToLower(host)]; ok {
+		for _, a := range connectTo {
+			h, p, _ := net.SplitHostPort(a)
+			if p == "" {
+				p = port
+			}
+			addrs = append(addrs, net.JoinHostPort(h, p))
+		}
+		return addrs, nil
+	}
+
+	var hosts []string
+	if net.ParseIP(host) != nil {
+		hosts = []string{host}
+	} else if static, ok := r.Static[strings.ToLower(host)]; ok {
+		hosts = static
+	} else if r.DoHURL != nil {
+		hosts, err = r.dohLookup(host)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Let the system resolver handle it.
+		hosts = []string{host}
+	}
+	for _, h := range hosts {
+		addrs = append(addrs, net.JoinHostPort(h, port))
+	}
+	return addrs, nil
+}
+
+// Dial addr, trying each of the addresses it resolves to in turn. Suitable for
+// http.Transport.Dial.
+func (r *Resolver) Dial(network, addr string) (net.Conn, error) {
+	addrs, err := r.resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, a := range addrs {
+		conn, err := net.DialTimeout(network, a, dialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+
+func TestDNSQuery(t *testing.T) {
+	badTests := [...]string{
+		"",
+		".",
+		"a..b",
+		"0123456789012345678901234567890123456789012345678901234567890123.example",
+	}
+
+	for _, input := range badTests {
+		_, err := dnsQuery(input, dnsTypeA)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+
+	query, err := dnsQuery("www.example.com.", dnsTypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte("\x00\x00\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x03www\x07example\x03com\x00\x00\x1c\x00\x01")
+	if !bytes.Equal(query, expected) {
+		t.Errorf("→ %q (expected %q)", query, expected)
+	}
+}
+
+func TestDNSAnswers(t *testing.T) {
+	query, err := dnsQuery("www.example.com", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Turn the query into a response with two answers: a CNAME with an
+	// uncompressed name and an A record with a compressed name.
+	resp := append([]byte{}, query...)
+	resp[2] |= 0x80
+	resp[7] = 2
+	resp = append(resp, []byte("\x03www\x07example\x03com\x00\x00\x05\x00\x01\x00\x00\x01\x00\x00\x02\xc0\x10")...)
+	resp = append(resp, []byte("\xc0\x10\x00\x01\x00\x01\x00\x00\x00\x3c\x00\x04\xc0\x00\x02\x01")...)
+
+	rrs, err := dnsAnswers(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 2 {
+		t.Fatalf("got %d answers (expected 2)", len(rrs))
+	}
+	if rrs[0].Type != 5 || rrs[0].TTL != 256 {
+		t.Errorf("answer 0 is %+v", rrs[0])
+	}
+	if rrs[1].Type != dnsTypeA || rrs[1].TTL != 60 || !bytes.Equal(rrs[1].Data, []byte{192, 0, 2, 1}) {
+		t.Errorf("answer 1 is %+v", rrs[1])
+	}
+
+	// Truncated responses and errors.
+	for i := 0; i < len(resp); i++ {
+		_, err := dnsAnswers(resp[:i])
+		if err == nil {
+			t.Errorf("truncation to %d bytes unexpectedly succeeded", i)
+		}
+	}
+	nxdomain := append([]byte{}, resp...)
+	nxdomain[3] |= 3
+	_, err = dnsAnswers(nxdomain)
+	if err == nil {
+		t.Errorf("NXDOMAIN unexpectedly succeeded")
+	}
+	_, err = dnsAnswers(query)
+	if err == nil {
+		t.Errorf("query unexpectedly succeeded")
+	}
+}
+
+func TestResolverResolve(t *testing.T) {
+	badTests := [...]struct {
+		connectTo, resolve, doh string
+	}{
+		{"example.com", "", ""},
+		{"192.0.2.1", "", ""},
+		{"www.example.com:example.net", "", ""},
+		{":192.0.2.1:443", "", ""},
+		{"", "example.com", ""},
+		{"", "example.com:example.net", ""},
+		{"", ":192.0.2.1", ""},
+		{"", "", "http://1.1.1.1/dns-query"},
+	}
+	goodTests := [...]struct {
+		connectTo, resolve string
+		input              string
+		expected           []string
+	}{
+		{"", "", "www.example.com:443", []string{"www.example.com:443"}},
+		{"", "", "192.0.2.1:443", []string{"192.0.2.1:443"}},
+		{"", "WWW.example.com:192.0.2.1,www.example.com:[2001:db8::1]", "www.EXAMPLE.com:443", []string{"192.0.2.1:443", "[2001:db8::1]:443"}},
+		{"", "www.example.com:192.0.2.1", "other.example.com:443", []string{"other.example.com:443"}},
+		{"WWW.example.com:192.0.2.2,www.example.com:[2001:db8::2]:8443,www.example.com:2001:db8::3", "www.example.com:192.0.2.1", "www.EXAMPLE.com:443", []string{"192.0.2.2:443", "[2001:db8::2]:8443", "[2001:db8::3]:443"}},
+		// connect-to applies only to the hosts it names.
+		{"www.example.com:192.0.2.2:8443", "other.example.com:192.0.2.1", "other.example.com:443", []string{"192.0.2.1:443"}},
+		{"www.example.com:192.0.2.2:8443", "", "other.example.com:443", []string{"other.example.com:443"}},
+	}
+
+	for _, test := range badTests {
+		_, err := makeResolver(test.connectTo, test.resolve, test.doh)
+		if err == nil {
+			t.Errorf("%q %q %q unexpectedly succeeded", test.connectTo, test.resolve, test.doh)
+		}
+	}
+
+	r, err := makeResolver("", "", "")
+	if err != nil || r != nil {
+		t.Errorf("empty options returned %v %v", r, err)
+	}
+
+	for _, test := range goodTests {
+		r, err := makeResolver(test.connectTo, test.resolve, "")
+		if err != nil {
+			t.Errorf("%q %q unexpectedly returned an error: %s", test.connectTo, test.resolve, err)
+			continue
+		}
+		if r == nil {
+			r = new(Resolver)
+		}
+		addrs, err := r.resolve(test.input)
+		if err != nil {
+			t.Errorf("%q %q %q unexpectedly returned an error: %s", test.connectTo, test.resolve, test.input, err)
+			continue
+		}
+		if len(addrs) != len(test.expected) {
+			t.Errorf("%q %q %q → %q (expected %q)", test.connectTo, test.resolve, test.input, addrs, test.expected)
+			continue
+		}
+		for i := range addrs {
+			if addrs[i] != test.expected[i] {
+				t.Errorf("%q %q %q → %q (expected %q)", test.connectTo, test.resolve, test.input, addrs, test.expected)
+				break
+			}
+		}
+	}
+}
+
+// The resolver options can't be combined with a proxy, since the proxy, not
+// meek-client, connects to the front.
+func TestMakeDialerResolverProxy(t *testing.T) {
+	options.Tuning = defaultTuning()
+	for _, key := range []string{"connect-to", "resolve", "doh"} {
+		value := map[string]string{
+			"connect-to": "www.example.com:192.0.2.1",
+			"resolve":    "www.example.com:192.0.2.1",
+			"doh":        "https://1.1.1.1/dns-query",
+		}[key]
+		socks := pt.Args{}
+		socks.Add("url", "https://meek.example.com/")
+		socks.Add("front", "www.example.com")
+		socks.Add(key, value)
+		_, err := makeDialer(&connArgs{socks: socks}, "", true)
+		if err != nil {
+			t.Errorf("%s without a proxy: %s", key, err)
+		}
+		socks.Add("proxy", "http://127.0.0.1:8080/")
+		_, err = makeDialer(&connArgs{socks: socks}, "", true)
+		if err == nil {
+			t.Errorf("%s with a proxy unexpectedly succeeded", key)
+		}
+	}
+}
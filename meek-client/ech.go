@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+// The code in this file has to do with Encrypted Client Hello, an alternative
+// to domain fronting. Instead of hiding the server name by putting a different
+// one in the SNI, ECH encrypts the real SNI under a public key published by the
+// server's operator, and the outer ClientHello shows only the "public name"
+// from the ECH configuration. The ECHConfigList may be given directly in base64,
+// or it may be fetched from the HTTPS DNS record of the URL's host through the
+// DoH resolver.
+//
+// https://datatracker.ietf.org/doc/html/draft-ietf-tls-esni
+// https://datatracker.ietf.org/doc/html/rfc9460
+
+const (
+	// Value of the ech option meaning to look up the ECHConfigList in DNS.
+	echFromDoH = "doh"
+	// SvcParamKey for ECH in SVCB and HTTPS records.
+	svcParamKeyECH = 5
+)
+
+// Check that echConfigList at least has the form of an ECHConfigList: a
+// non-empty vector with a 2-byte length prefix. The individual ECHConfigs are
+// checked by crypto/tls.
+func checkECHConfigList(echConfigList []byte) error {
+	if len(echConfigList) <= 2 || int(binary.BigEndian.Uint16(echConfigList)) != len(echConfigList)-2 {
+		return errors.New("malformed ECHConfigList")
+	}
+	return nil
+}
+
+// Decode a base64-encoded ECHConfigList from the ech option.
+func parseECHConfigList(s string) ([]byte, error) {
+	echConfigList, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("can't decode ECHConfigList: %s", err))
+	}
+	err = checkECHConfigList(echConfigList)
+	if err != nil {
+		return nil, err
+	}
+	return echConfigList, nil
+}
+
+// Return the value of the ech SvcParam in the RDATA of an HTTPS record, or nil
+// if there is none.
+func httpsRecordECH(rdata []byte) ([]byte, error) {
+	// SvcPriority.
+	if len(rdata) < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	// TargetName, which is never compressed.
+	off, err := dnsSkipName(rdata, 2)
+	if err != nil {
+		return nil, err
+	}
+	// SvcParams.
+	for off < len(rdata) {
+		if off+4 > len(rdata) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		key := binary.BigEndian.Uint16(rdata[off : off+2])
+		length := int(binary.BigEndian.Uint16(rdata[off+2 : off+4]))
+		off += 4
+		if off+length > len(rdata) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if key == svcParamKeyECH {
+			return rdata[off : off+length], nil
+		}
+		off += length
+	}
+	return nil, nil
+}
+
+// Look up the ECHConfigList for host and port in its HTTPS DNS record, using
+// the resolver's DoH server.
+func (r *Resolver) lookupECHConfigList(host, port string) ([]byte, error) {
+	if r == nil || r.DoHURL == nil {
+		return nil, errors.New("looking up an ECHConfigList requires the doh option")
+	}
+	// RFC 9460 section 9.1: a non-default port is prefixed to the name.
+	name := host
+	if port != "" && port != "443" {
+		name = fmt.Sprintf("_%s._https.%s", port, host)
+	}
+	rrs, err := r.dohQuery(name, dnsTypeHTTPS)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range rrs {
+		if rr.Type != dnsTypeHTTPS {
+			continue
+		}
+		ech, err := httpsRecordECH(rr.Data)
+		if err != nil {
+			return nil, err
+		}
+		if ech != nil {
+			err = checkECHConfigList(ech)
+			if err != nil {
+				return nil, err
+			}
+			return ech, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("no ECHConfigList in HTTPS record for %s", name))
+}
+
+// Return a copy of base (which may be nil) that uses ECH for connections to u.
+// The ech option is either a base64-encoded ECHConfigList or "doh", meaning to
+// look up the ECHConfigList using r.
+func makeECHTLSConfig(base *tls.Config, ech string, u *url.URL, r *Resolver) (*tls.Config, error) {
+	if u.Scheme != "https" {
+		return nil, errors.New(fmt.Sprintf("ECH requires an https URL, not %q", u.String()))
+	}
+	var echConfigList []byte
+	var err error
+	if ech == echFromDoH {
+		echConfigList, err = r.lookupECHConfigList(u.Hostname(), u.Port())
+	} else {
+		echConfigList, err = parseECHConfigList(ech)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	config.EncryptedClientHelloConfigList = echConfigList
+	return config, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseECHConfigList(t *testing.T) {
+	badTests := [...]string{
+		"",
+		"AA==",
+		"AAA=",
+		"AAIAAAA=",
+		"not base64",
+	}
+
+	for _, input := range badTests {
+		_, err := parseECHConfigList(input)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+
+	echConfigList, err := parseECHConfigList("AAL+DQ==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echConfigList, []byte{0x00, 0x02, 0xfe, 0x0d}) {
+		t.Errorf("got %x", echConfigList)
+	}
+}
+
+func TestHTTPSRecordECH(t *testing.T) {
+	badTests := [...][]byte{
+		[]byte(""),
+		[]byte("\x00"),
+		[]byte("\x00\x01"),
+		[]byte("\x00\x01\x00\x00"),
+		[]byte("\x00\x01\x00\x00\x05\x00\x04\xaa"),
+	}
+
+	for _, input := range badTests {
+		_, err := httpsRecordECH(input)
+		if err == nil {
+			t.Errorf("%x unexpectedly succeeded", input)
+		}
+	}
+
+	// Priority 1, target ".", alpn=h2, ech=\x00\x02\xfe\x0d.
+	rdata := []byte("\x00\x01\x00\x00\x01\x00\x03\x02h2\x00\x05\x00\x04\x00\x02\xfe\x0d")
+	ech, err := httpsRecordECH(rdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ech, []byte{0x00, 0x02, 0xfe, 0x0d}) {
+		t.Errorf("got %x", ech)
+	}
+
+	// No ech.
+	ech, err = httpsRecordECH([]byte("\x00\x01\x07example\x00\x00\x01\x00\x03\x02h2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ech != nil {
+		t.Errorf("got %x", ech)
+	}
+}
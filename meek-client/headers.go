@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The code in this file has to do with extra header fields added to every
+// request, so that requests look more like those of a browser. A header
+// template is a list of "Name: value" lines, either in a file or given one at a
+// time with header= SOCKS args or --header options.
+//
+// The order of fields is preserved. In helper mode, the fields are passed to the
+// browser extension in order. In direct mode, the template's field names become
+// the Dialer's HeaderOrder, so requests have Host first, then the template's
+// fields in order, then the fields that meek and Go's net/http add.
+
+// A single header field.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Header fields that are controlled by meek itself or by the transport, and
+// may not appear in a template.
+var reservedHeaderFields = []string{
+	"Connection",
+	"Content-Length",
+	"Host",
+	"Transfer-Encoding",
+	"X-Session-Id",
+	"X-Session-Seq",
+	"X-Session-Target",
+}
+
+// Parse a "Name: value" line.
+func parseHeaderField(line string) (HeaderField, error) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return HeaderField{}, errors.New(fmt.Sprintf("header field %q is not Name: value", line))
+	}
+	name := strings.TrimSpace(line[:i])
+	value := strings.TrimSpace(line[i+1:])
+	if name == "" || strings.ContainsAny(name, " \t\r\n") || strings.ContainsAny(value, "\r\n") {
+		return HeaderField{}, errors.New(fmt.Sprintf("header field %q is not Name: value", line))
+	}
+	name = http.CanonicalHeaderKey(name)
+	for _, reserved := range reservedHeaderFields {
+		if name == reserved {
+			return HeaderField{}, errors.New(fmt.Sprintf("header field %s can't be set in a template", name))
+		}
+	}
+	return HeaderField{name, value}, nil
+}
+
+// Parse a list of "Name: value" lines.
+func parseHeaderFields(lines []string) ([]HeaderField, error) {
+	var fields []HeaderField
+	for _, line := range lines {
+		field, err := parseHeaderField(line)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Read a header template file. Blank lines and lines beginning with '#' are
+// ignored.
+func loadHeaderFile(filename string) ([]HeaderField, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	err = s.Err()
+	if err != nil {
+		return nil, err
+	}
+	fields, err := parseHeaderFields(lines)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", filename, err))
+	}
+	return fields, nil
+}
+
+// Return base with the fields of override merged in. A field in override
+// replaces any of the same name in base, keeping its position; others are
+// appended.
+func mergeHeaderFields(base, override []HeaderField) []HeaderField {
+	merged := append([]HeaderField{}, base...)
+outer:
+	for _, field := range override {
+		for i := range merged {
+			if merged[i].Name == field.Name {
+				merged[i] = field
+				continue outer
+			}
+		}
+		merged = append(merged, field)
+	}
+	return merged
+}
+
+// Set the fields in an http.Header.
+func setHeaderFields(header http.Header, fields []HeaderField) {
+	for _, field := range fields {
+		header.Set(field.Name, field.Value)
+	}
+}
+
+// A list of header fields that encodes as a JSON object with the keys in list
+// order, rather than sorted as a map would be.
+type JSONHeader []HeaderField
+
+func (h JSONHeader) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range h {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(field.Name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// A flag.Value that collects every instance of a repeated option.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+
+func TestParseHeaderField(t *testing.T) {
+	badTests := [...]string{
+		"",
+		"User-Agent",
+		": value",
+		"Bad Name: value",
+		"Name: bad\r\nvalue",
+		"Host: example.com",
+		"x-session-id: 1234",
+		"X-Session-Target: 127.0.0.1:22",
+		"Content-Length: 0",
+	}
+	goodTests := [...]struct {
+		input    string
+		expected HeaderField
+	}{
+		{"User-Agent: Mozilla/5.0", HeaderField{"User-Agent", "Mozilla/5.0"}},
+		{"accept-language:en-US,en;q=0.5", HeaderField{"Accept-Language", "en-US,en;q=0.5"}},
+		{"  X-Custom :  a: b  ", HeaderField{"X-Custom", "a: b"}},
+		{"Referer:", HeaderField{"Referer", ""}},
+	}
+
+	for _, input := range badTests {
+		_, err := parseHeaderField(input)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+
+	for _, test := range goodTests {
+		field, err := parseHeaderField(test.input)
+		if err != nil {
+			t.Errorf("%q unexpectedly returned an error: %s", test.input, err)
+			continue
+		}
+		if field != test.expected {
+			t.Errorf("%q → %q (expected %q)", test.input, field, test.expected)
+		}
+	}
+}
+
+func TestMergeHeaderFields(t *testing.T) {
+	base := []HeaderField{{"User-Agent", "a"}, {"Accept", "b"}}
+	override := []HeaderField{{"X-Custom", "c"}, {"User-Agent", "d"}}
+	expected := []HeaderField{{"User-Agent", "d"}, {"Accept", "b"}, {"X-Custom", "c"}}
+
+	merged := mergeHeaderFields(base, override)
+	if len(merged) != len(expected) {
+		t.Fatalf("→ %q (expected %q)", merged, expected)
+	}
+	for i := range merged {
+		if merged[i] != expected[i] {
+			t.Fatalf("→ %q (expected %q)", merged, expected)
+		}
+	}
+	if base[0].Value != "a" {
+		t.Errorf("base was modified: %q", base)
+	}
+}
+
+func TestJSONHeaderOrder(t *testing.T) {
+	h := JSONHeader{{"Z", "1"}, {"A", "\"2\""}, {"M", ""}}
+	enc, err := json.Marshal(struct {
+		Header JSONHeader `json:"header,omitempty"`
+	}{h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"header":{"Z":"1","A":"\"2\"","M":""}}`
+	if string(enc) != expected {
+		t.Errorf("→ %s (expected %s)", enc, expected)
+	}
+}
+
+// In direct mode, the template's field names become the Dialer's HeaderOrder.
+func TestMakeDialerHeaderOrder(t *testing.T) {
+	options.Tuning = defaultTuning()
+	socks := pt.Args{}
+	socks.Add("url", "https://meek.example.com/")
+	socks.Add("header", "User-Agent: a")
+	socks.Add("header", "Accept: b")
+	socks.Add("header", "Accept-Language: c")
+	dialer, err := makeDialer(&connArgs{socks: socks}, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"User-Agent", "Accept", "Accept-Language"}
+	if !reflect.DeepEqual(dialer.HeaderOrder, expected) {
+		t.Errorf("→ %q (expected %q)", dialer.HeaderOrder, expected)
+	}
+}
@@ -19,11 +19,11 @@ import (
 // browser extension.
 
 type JSONRequest struct {
-	Method string            `json:"method,omitempty"`
-	URL    string            `json:"url,omitempty"`
-	Header map[string]string `json:"header,omitempty"`
-	Body   []byte            `json:"body,omitempty"`
-	Proxy  *ProxySpec        `json:"proxy,omitempty"`
+	Method string     `json:"method,omitempty"`
+	URL    string     `json:"url,omitempty"`
+	Header JSONHeader `json:"header,omitempty"`
+	Body   []byte     `json:"body,omitempty"`
+	Proxy  *ProxySpec `json:"proxy,omitempty"`
 }
 
 type JSONResponse struct {
@@ -81,10 +81,33 @@ func makeProxySpec(u *url.URL) (*ProxySpec, error) {
 	return spec, nil
 }
 
-// Do an HTTP roundtrip through the configured browser extension, using the
-// payload data in buf and the request metadata in info.
-func roundTripWithHelper(buf []byte, info *RequestInfo) (*http.Response, error) {
-	s, err := net.DialTCP("tcp", nil, options.HelperAddr)
+// An http.RoundTripper that makes requests through the browser extension. The
+// header fields of a request are sent in the order of Header, followed by
+// X-Session-Id, X-Session-Seq, X-Session-Target, and Host; any others in the
+// request are ignored.
+type helperTransport struct {
+	// Address of the browser extension.
+	Addr *net.TCPAddr
+	// Extra header fields to add to every request.
+	Header []HeaderField
+	// URL of an upstream proxy for the browser to use. If nil, no proxy is
+	// used.
+	ProxyURL *url.URL
+}
+
+// Do an HTTP roundtrip through the browser extension.
+func (t *helperTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var buf []byte
+	if r.Body != nil {
+		var err error
+		buf, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := net.DialTCP("tcp", nil, t.Addr)
 	if err != nil {
 		return nil, err
 	}
@@ -92,16 +115,21 @@ func roundTripWithHelper(buf []byte, info *RequestInfo) (*http.Response, error)
 
 	// Encode our JSON.
 	req := JSONRequest{
-		Method: "POST",
-		URL:    info.URL.String(),
-		Header: make(map[string]string),
+		Method: r.Method,
+		URL:    r.URL.String(),
+		Header: append(JSONHeader{}, t.Header...),
 		Body:   buf,
 	}
-	req.Header["X-Session-Id"] = info.SessionID
-	if info.Host != "" {
-		req.Header["Host"] = info.Host
+	for _, name := range []string{"X-Session-Id", "X-Session-Seq", "X-Session-Target"} {
+		value := r.Header.Get(name)
+		if value != "" {
+			req.Header = append(req.Header, HeaderField{name, value})
+		}
+	}
+	if r.Host != "" {
+		req.Header = append(req.Header, HeaderField{"Host", r.Host})
 	}
-	req.Proxy, err = makeProxySpec(options.ProxyURL)
+	req.Proxy, err = makeProxySpec(t.ProxyURL)
 	if err != nil {
 		return nil, err
 	}
@@ -154,6 +182,7 @@ func roundTripWithHelper(buf []byte, info *RequestInfo) (*http.Response, error)
 	resp := http.Response{
 		Status:        http.StatusText(jsonResp.Status),
 		StatusCode:    jsonResp.Status,
+		Header:        make(http.Header),
 		Body:          ioutil.NopCloser(bytes.NewReader(jsonResp.Body)),
 		ContentLength: int64(len(jsonResp.Body)),
 	}
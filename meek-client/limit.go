@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+// The code in this file has to do with limits on how much meek-client sends and
+// receives, for users on metered connections. --upload-rate and
+// --download-rate limit bandwidth in bytes per second, and --byte-budget limits
+// the total number of bytes for the whole run, over all sessions:
+// 	meek-client --upload-rate 64K --download-rate 256K --byte-budget 500M
+// Sizes may have a K, M, or G suffix (powers of 1024). When the budget is used
+// up, the session that notices is closed and later ones are refused, with a log
+// message each time; restart meek-client to start a new budget.
+
+// The smallest nonzero rate. Slower rates would make a full-size payload take
+// longer than a minute.
+const minClientRate = 1024
+
+// Limits for all sessions; nil unless one of the options was given.
+var limit *meek.ClientLimit
+
+// A number of bytes, with an optional K, M, or G suffix. It is a flag.Value.
+type byteSize int64
+
+func (size *byteSize) String() string {
+	return strconv.FormatInt(int64(*size), 10)
+}
+
+func (size *byteSize) Set(s string) error {
+	multiplier := int64(1)
+	digits := s
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		}
+		if multiplier != 1 {
+			digits = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/multiplier {
+		return errors.New(fmt.Sprintf("bad size %q", s))
+	}
+	*size = byteSize(n * multiplier)
+	return nil
+}
+
+// The --upload-rate, --download-rate, and --byte-budget options.
+type limitOptions struct {
+	UploadRate   byteSize
+	DownloadRate byteSize
+	ByteBudget   byteSize
+}
+
+// Return an error if either rate is out of range.
+func (opts *limitOptions) Check() error {
+	for _, rate := range []struct {
+		name  string
+		value byteSize
+	}{
+		{"upload-rate", opts.UploadRate},
+		{"download-rate", opts.DownloadRate},
+	} {
+		if rate.value != 0 && (rate.value < minClientRate || rate.value > 1<<31-1) {
+			return errors.New(fmt.Sprintf("%s must be 0 or between %d and %d", rate.name, minClientRate, 1<<31-1))
+		}
+	}
+	return nil
+}
+
+// Return a meek.ClientLimit for the options, or nil if there are no limits.
+func (opts *limitOptions) ClientLimit() *meek.ClientLimit {
+	if opts.UploadRate == 0 && opts.DownloadRate == 0 && opts.ByteBudget == 0 {
+		return nil
+	}
+	return meek.NewClientLimit(int(opts.UploadRate), int(opts.DownloadRate), int64(opts.ByteBudget))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestByteSize(t *testing.T) {
+	goodTests := []struct {
+		input    string
+		expected byteSize
+	}{
+		{"0", 0},
+		{"1500", 1500},
+		{"64K", 64 << 10},
+		{"64k", 64 << 10},
+		{"500M", 500 << 20},
+		{"2G", 2 << 30},
+	}
+	for _, test := range goodTests {
+		var size byteSize
+		err := size.Set(test.input)
+		if err != nil {
+			t.Errorf("%q → error %s", test.input, err)
+		} else if size != test.expected {
+			t.Errorf("%q → %d (expected %d)", test.input, size, test.expected)
+		}
+	}
+
+	badTests := [...]string{
+		"",
+		"K",
+		"-1",
+		"1.5M",
+		"10T",
+		"1 M",
+		"99999999999G",
+	}
+	for _, input := range badTests {
+		var size byteSize
+		err := size.Set(input)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded: %d", input, size)
+		}
+	}
+}
+
+func TestLimitOptions(t *testing.T) {
+	opts := limitOptions{}
+	if opts.Check() != nil || opts.ClientLimit() != nil {
+		t.Errorf("no limits: %v %v", opts.Check(), opts.ClientLimit())
+	}
+
+	opts = limitOptions{ByteBudget: 1 << 20}
+	if opts.Check() != nil || opts.ClientLimit() == nil {
+		t.Errorf("budget only: %v %v", opts.Check(), opts.ClientLimit())
+	}
+
+	for _, opts := range []limitOptions{
+		{UploadRate: 100},
+		{DownloadRate: minClientRate - 1},
+		{DownloadRate: 1 << 32},
+	} {
+		if opts.Check() == nil {
+			t.Errorf("%+v unexpectedly succeeded", opts)
+		}
+	}
+}
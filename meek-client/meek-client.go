@@ -26,13 +26,71 @@
 // The --helper option prevents this program from doing any network operations
 // itself. Rather, it will send all requests through a browser extension that
 // makes HTTP requests.
+//
+// The url and front options may be comma-separated lists. Each (url, front)
+// pairing is a separate path to the server, and requests belonging to a single
+// session are spread across all the paths at once:
+// 	Bridge meek 0.0.2.0:1 url=https://meek-reflect.appspot.com/ front=www.google.com,mail.google.com
+// This needs a meek-server that understands the X-Session-Seq header.
+//
+// The ca and pin options control which certificates are accepted from the
+// front. ca names a file of PEM-encoded CA certificates to use instead of the
+// system roots. pin is a comma-separated list of "sha256/" followed by the
+// base64-encoded SHA-256 digest of a SubjectPublicKeyInfo; the front's
+// certificate chain must contain one of the pinned keys:
+// 	Bridge meek 0.0.2.0:1 url=https://meek-reflect.appspot.com/ front=www.google.com pin=sha256/7HIpactkIAq2Y49orFOOQKurWxmmSFZhBCoQYcRhJ3Y=
+// These options don't work with --helper, because then it is the browser that
+// makes the TLS connection.
+//
+// The connect-to, resolve, and doh options control where the TCP connection
+// to the front goes, without changing the SNI or Host. connect-to is a
+// comma-separated list of HOST:ADDRESS mappings, where ADDRESS is an IP address
+// optionally with a port, giving where to connect in place of each front HOST.
+// resolve is a comma-separated list of HOST:ADDRESS static mappings, like curl
+// --resolve. doh is the URL of a DNS-over-HTTPS
+// server to use instead of the system resolver:
+// 	Bridge meek 0.0.2.0:1 url=https://meek-reflect.appspot.com/ front=www.google.com doh=https://1.1.1.1/dns-query
+// These options also don't work with --helper, nor with a proxy, which does its
+// own resolving.
+//
+// The ech option enables Encrypted Client Hello, an alternative to domain
+// fronting that encrypts the real server name in the TLS ClientHello. Its value
+// is either a base64-encoded ECHConfigList, or "doh" to look up the
+// ECHConfigList in the HTTPS DNS record of the URL's host using the doh
+// resolver. ech can't be used together with front or with --helper:
+// 	Bridge meek 0.0.2.0:1 url=https://meek.example.com/ ech=doh doh=https://1.1.1.1/dns-query
+//
+// Extra header fields, such as User-Agent, can be added to every request to
+// make it look more like a browser's. The headers option names a file of
+// "Name: value" lines, in the order they should be sent. Each header option
+// (which may be repeated) adds or replaces one field:
+// 	Bridge meek 0.0.2.0:1 url=https://meek-reflect.appspot.com/ front=www.google.com headers=firefox.txt header=Accept-Language:\ en-US,en;q=0.5
+//
+// Instead of repeating options on every Bridge line, they can be collected into
+// named profiles in a configuration file given by --config, and selected with
+// the profile SOCKS arg (or --profile). See config.go for the format and for
+// how profile options combine with SOCKS args and command line options:
+// 	Bridge meek 0.0.2.0:1 profile=google
+// 	ClientTransportPlugin meek exec ./meek-client --config=meek-client.json
+//
+// The polling and retry parameters can also be set per bridge; see tuning.go.
+//
+// This program handles configuration and the interface with tor; the transport
+// itself is the meek package, which other Go programs can use directly.
+//
+// With --socks or --http-connect, meek-client runs in standalone mode, without
+// tor, as a local SOCKS5 or HTTP CONNECT proxy; see standalone.go:
+// 	meek-client --socks=127.0.0.1:1080 --url=https://meek.example.com/
+//
+// With --status-interval, statistics about sessions and fronts are summarized
+// in the log periodically; with --metrics, they are served in the Prometheus
+// text format. See metrics.go.
+//
+// --upload-rate and --download-rate limit bandwidth, and --byte-budget limits
+// the number of bytes used by the whole run; see limit.go.
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"crypto/rand"
-	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
@@ -48,32 +106,10 @@ import (
 )
 
 import "git.torproject.org/pluggable-transports/goptlib.git"
+import "git.torproject.org/pluggable-transports/meek.git/meek"
 
 const (
 	ptMethodName = "meek"
-	// A session ID is a randomly generated string that identifies a
-	// long-lived session. We split a TCP stream across multiple HTTP
-	// requests, and those with the same session ID belong to the same
-	// stream.
-	sessionIdLength = 32
-	// The size of the largest chunk of data we will read from the SOCKS
-	// port before forwarding it in a request, and the maximum size of a
-	// body we are willing to handle in a reply.
-	maxPayloadLength = 0x10000
-	// We must poll the server to see if it has anything to send; there is
-	// no way for the server to push data back to us until we send an HTTP
-	// request. When a timer expires, we send a request even if it has an
-	// empty body. The interval starts at this value and then grows.
-	initPollInterval = 100 * time.Millisecond
-	// Maximum polling interval.
-	maxPollInterval = 5 * time.Second
-	// Geometric increase in the polling interval each time we fail to read
-	// data.
-	pollIntervalMultiplier = 1.5
-	// Try an HTTP roundtrip at most this many times.
-	maxTries = 10
-	// Wait this long between retries.
-	retryDelay = 30 * time.Second
 	// Safety limits on interaction with the HTTP helper.
 	maxHelperResponseLength = 10000000
 	helperReadTimeout       = 60 * time.Second
@@ -88,174 +124,177 @@ var options struct {
 	Front      string
 	ProxyURL   *url.URL
 	HelperAddr *net.TCPAddr
+	CAFilename string
+	Pins       string
+	ConnectTo  string
+	Resolve    string
+	DoH        string
+	ECH        string
+	// Name of a header template file.
+	HeadersFilename string
+	// Individual "Name: value" header fields.
+	Headers stringList
+	// Profiles from the configuration file, and the name of the one to
+	// use when there's no profile= SOCKS arg.
+	Profiles map[string]pt.Args
+	Profile  string
+	// Polling and retry parameters.
+	Tuning Tuning
+	// Whether to log debugging messages.
+	Debug bool
 }
 
 // When a connection handler starts, +1 is written to this channel; when it
 // ends, -1 is written.
 var handlerChan = make(chan int)
 
-// RequestInfo encapsulates all the configuration used for a request–response
-// roundtrip, including variables that may come from SOCKS args or from the
-// command line.
-type RequestInfo struct {
-	// What to put in the X-Session-ID header.
-	SessionID string
-	// The URL to request.
-	URL *url.URL
-	// The Host header to put in the HTTP request (optional and may be
-	// different from the host name in URL).
-	Host string
-	// URL of an upstream proxy to use. If nil, no proxy is used.
-	ProxyURL *url.URL
+// Log a message only if --debug was given.
+func debugf(format string, v ...interface{}) {
+	if options.Debug {
+		log.Printf(format, v...)
+	}
 }
 
-// Do an HTTP roundtrip using the payload data in buf and the request metadata
-// in info.
-func roundTripWithHTTP(buf []byte, info *RequestInfo) (*http.Response, error) {
-	tr := new(http.Transport)
-	if info.ProxyURL != nil {
-		if info.ProxyURL.Scheme != "http" {
-			panic(fmt.Sprintf("don't know how to use proxy %s", info.ProxyURL.String()))
-		}
-		tr.Proxy = http.ProxyURL(info.ProxyURL)
+// Make the meek.Dialer for a new session from the per-connection options in
+// args. target is the SOCKS target, used to make a URL if there is no url
+// option. If validateOnly is true, only check the options, skipping anything
+// that needs the network.
+func makeDialer(args *connArgs, target string, validateOnly bool) (*meek.Dialer, error) {
+	// First check url= SOCKS arg, then --url option, then SOCKS target.
+	urlArg, ok := args.get("url", options.URL)
+	if !ok {
+		urlArg = (&url.URL{
+			Scheme: "http",
+			Host:   target,
+			Path:   "/",
+		}).String()
 	}
-	req, err := http.NewRequest("POST", info.URL.String(), bytes.NewReader(buf))
+
+	// First check front= SOCKS arg, then --front option.
+	front, _ := args.get("front", options.Front)
+
+	paths, err := makePaths(splitList(urlArg), splitList(front))
 	if err != nil {
 		return nil, err
 	}
-	if info.Host != "" {
-		req.Host = info.Host
-	}
-	req.Header.Set("X-Session-Id", info.SessionID)
-	return tr.RoundTrip(req)
-}
 
-// Do a roundtrip, trying at most limit times if there is an HTTP status other
-// than 200. In case all tries result in error, returns the last error seen.
-//
-// Retrying the request immediately is a bit bogus, because we don't know if the
-// remote server received our bytes or not, so we may be sending duplicates,
-// which will cause the connection to die. The alternative, though, is to just
-// kill the connection immediately. A better solution would be a system of
-// acknowledgements so we know what to resend after an error.
-func roundTripRetries(buf []byte, info *RequestInfo, limit int) (*http.Response, error) {
-	roundTrip := roundTripWithHTTP
-	if options.HelperAddr != nil {
-		roundTrip = roundTripWithHelper
-	}
-	var resp *http.Response
-	var err error
-again:
-	limit--
-	resp, err = roundTrip(buf, info)
-	// Retry only if the HTTP roundtrip completed without error, but
-	// returned a status other than 200. Other kinds of errors and success
-	// with 200 always return immediately.
-	if err == nil && resp.StatusCode != http.StatusOK {
-		err = errors.New(fmt.Sprintf("status code was %d, not %d", resp.StatusCode, http.StatusOK))
-		if limit > 0 {
-			log.Printf("%s; trying again after %.f seconds (%d)", err, retryDelay.Seconds(), limit)
-			time.Sleep(retryDelay)
-			goto again
+	// First check proxy= SOCKS arg, then --proxy option/managed
+	// configuration.
+	var proxyURL *url.URL
+	proxy, ok := args.get("proxy", "")
+	if ok {
+		proxyURL, err = url.Parse(proxy)
+		if err != nil {
+			return nil, err
 		}
+	} else if options.ProxyURL != nil {
+		proxyURL = options.ProxyURL
 	}
-	return resp, err
-}
 
-// Send the data in buf to the remote URL, wait for a reply, and feed the reply
-// body back into conn.
-func sendRecv(buf []byte, conn net.Conn, info *RequestInfo) (int64, error) {
-	resp, err := roundTripRetries(buf, info, maxTries)
+	// First check ca= and pin= SOCKS args, then --ca and --pin options.
+	caFilename, _ := args.get("ca", options.CAFilename)
+	pins, _ := args.get("pin", options.Pins)
+	tlsConfig, err := makeTLSConfig(caFilename, pins)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	if tlsConfig != nil && options.HelperAddr != nil {
+		return nil, errors.New("the ca and pin options can't be used with --helper")
 	}
-	defer resp.Body.Close()
-	return io.Copy(conn, io.LimitReader(resp.Body, maxPayloadLength))
-}
-
-// Repeatedly read from conn, issue HTTP requests, and write the responses back
-// to conn.
-func copyLoop(conn net.Conn, info *RequestInfo) error {
-	var interval time.Duration
-
-	ch := make(chan []byte)
 
-	// Read from the Conn and send byte slices on the channel.
-	go func() {
-		var buf [maxPayloadLength]byte
-		r := bufio.NewReader(conn)
-		for {
-			n, err := r.Read(buf[:])
-			b := make([]byte, n)
-			copy(b, buf[:n])
-			// log.Printf("read from local: %q", b)
-			ch <- b
-			if err != nil {
-				log.Printf("error reading from local: %s", err)
-				break
-			}
+	// First check connect-to=, resolve=, and doh= SOCKS args, then
+	// --connect-to, --resolve, and --doh options.
+	connectTo, _ := args.get("connect-to", options.ConnectTo)
+	resolve, _ := args.get("resolve", options.Resolve)
+	doh, _ := args.get("doh", options.DoH)
+	resolver, err := makeResolver(connectTo, resolve, doh)
+	if err != nil {
+		return nil, err
+	}
+	if resolver != nil {
+		if options.HelperAddr != nil {
+			return nil, errors.New("the connect-to, resolve, and doh options can't be used with --helper")
 		}
-		close(ch)
-	}()
-
-	interval = initPollInterval
-loop:
-	for {
-		var buf []byte
-		var ok bool
+		// Through a proxy, it is the proxy that connects to the front,
+		// and the resolver would only change where the proxy is.
+		if proxyURL != nil {
+			return nil, errors.New("the connect-to, resolve, and doh options can't be used with a proxy")
+		}
+	}
 
-		// log.Printf("waiting up to %.2f s", interval.Seconds())
-		// start := time.Now()
-		select {
-		case buf, ok = <-ch:
-			if !ok {
-				break loop
-			}
-			// log.Printf("read %d bytes from local after %.2f s", len(buf), time.Since(start).Seconds())
-		case <-time.After(interval):
-			// log.Printf("read nothing from local after %.2f s", time.Since(start).Seconds())
-			buf = nil
+	// First check ech= SOCKS arg, then --ech option.
+	ech, _ := args.get("ech", options.ECH)
+	if ech != "" {
+		if options.HelperAddr != nil {
+			return nil, errors.New("the ech option can't be used with --helper")
+		}
+		if front != "" {
+			return nil, errors.New("the ech and front options can't be used together")
 		}
+	}
 
-		nw, err := sendRecv(buf, conn, info)
+	// First check headers= SOCKS arg, then --headers option, for a
+	// template file. Then apply header= SOCKS args, or if there are none,
+	// --header options.
+	headersFilename, _ := args.get("headers", options.HeadersFilename)
+	var headers []HeaderField
+	if headersFilename != "" {
+		headers, err = loadHeaderFile(headersFilename)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		/*
-			if nw > 0 {
-				log.Printf("got %d bytes from remote", nw)
-			} else {
-				log.Printf("got nothing from remote")
+	}
+	fields, err := parseHeaderFields(args.getAll("header", options.Headers))
+	if err != nil {
+		return nil, err
+	}
+	headers = mergeHeaderFields(headers, fields)
+
+	tuning, err := makeTuning(args)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range paths {
+		if ech == echFromDoH && validateOnly {
+			if resolver == nil || resolver.DoHURL == nil {
+				return nil, errors.New("ech=doh requires the doh option")
+			}
+		} else if ech != "" {
+			paths[i].TLSConfig, err = makeECHTLSConfig(tlsConfig, ech, paths[i].URL, resolver)
+			if err != nil {
+				return nil, err
 			}
-		*/
-
-		if nw > 0 || len(buf) > 0 {
-			// If we sent or received anything, poll again
-			// immediately.
-			interval = 0
-		} else if interval == 0 {
-			// The first time we don't send or receive anything,
-			// wait a while.
-			interval = initPollInterval
-		} else {
-			// After that, wait a little longer.
-			interval = time.Duration(float64(interval) * pollIntervalMultiplier)
-		}
-		if interval > maxPollInterval {
-			interval = maxPollInterval
 		}
 	}
 
-	return nil
-}
-
-func genSessionId() string {
-	buf := make([]byte, sessionIdLength)
-	_, err := rand.Read(buf)
-	if err != nil {
-		panic(err.Error())
+	dialer := &meek.Dialer{
+		Paths:     paths,
+		TLSConfig: tlsConfig,
+		Header:    make(http.Header),
+		Tuning:    meek.Tuning(*tuning),
+		Metrics:   metrics,
+		Limit:     limit,
+		Logf:      log.Printf,
+		Debugf:    debugf,
+	}
+	setHeaderFields(dialer.Header, headers)
+	if resolver != nil {
+		dialer.NetDial = resolver.Dial
 	}
-	return base64.StdEncoding.EncodeToString(buf)
+	if options.HelperAddr != nil {
+		dialer.Transport = &helperTransport{
+			Addr:     options.HelperAddr,
+			Header:   headers,
+			ProxyURL: proxyURL,
+		}
+	} else {
+		dialer.ProxyURL = proxyURL
+		for _, field := range headers {
+			dialer.HeaderOrder = append(dialer.HeaderOrder, field.Name)
+		}
+	}
+	return dialer, nil
 }
 
 // Callback for new SOCKS requests.
@@ -271,51 +310,67 @@ func handler(conn *pt.SocksConn) error {
 		return err
 	}
 
-	var info RequestInfo
-	info.SessionID = genSessionId()
+	return handleSession(conn, conn.Req.Args, conn.Req.Target, false)
+}
 
-	// First check url= SOCKS arg, then --url option, then SOCKS target.
-	urlArg, ok := conn.Req.Args.Get("url")
-	if ok {
-	} else if options.URL != "" {
-		urlArg = options.URL
-	} else {
-		urlArg = (&url.URL{
-			Scheme: "http",
-			Host:   conn.Req.Target,
-			Path:   "/",
-		}).String()
-	}
-	info.URL, err = url.Parse(urlArg)
+// Copy between conn and a new meek session, configured by socksArgs (which may
+// be nil) and the command line. target is the address requested of the SOCKS
+// (or HTTP CONNECT) proxy. If sendTarget is true, the server is asked to
+// connect the session to target.
+func handleSession(conn net.Conn, socksArgs pt.Args, target string, sendTarget bool) error {
+	dialer, err := sessionDialer(socksArgs, target, sendTarget)
 	if err != nil {
 		return err
 	}
+	return copySession(conn, dialer)
+}
 
-	// First check front= SOCKS arg, then --front option.
-	front, ok := conn.Req.Args.Get("front")
-	if ok {
-	} else if options.Front != "" {
-		front = options.Front
-		ok = true
+// Make the Dialer for a session of handleSession, so that a bad configuration
+// can be reported before the SOCKS or HTTP CONNECT request is answered.
+func sessionDialer(socksArgs pt.Args, target string, sendTarget bool) (*meek.Dialer, error) {
+	// First check profile= SOCKS arg, then --profile option.
+	args := connArgs{socks: socksArgs}
+	profileName, ok := socksArgs.Get("profile")
+	if !ok {
+		profileName = options.Profile
 	}
-	if ok {
-		info.Host = info.URL.Host
-		info.URL.Host = front
+	if profileName != "" {
+		args.profile, ok = options.Profiles[profileName]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("no profile named %q", profileName))
+		}
 	}
 
-	// First check proxy= SOCKS arg, then --proxy option/managed
-	// configuration.
-	proxy, ok := conn.Req.Args.Get("proxy")
-	if ok {
-		info.ProxyURL, err = url.Parse(proxy)
-		if err != nil {
-			return err
-		}
-	} else if options.ProxyURL != nil {
-		info.ProxyURL = options.ProxyURL
+	dialer, err := makeDialer(&args, target, false)
+	if err != nil {
+		return nil, err
+	}
+	if sendTarget {
+		dialer.Target = target
 	}
+	return dialer, nil
+}
 
-	return copyLoop(conn, &info)
+// Copy between conn and a new meek session made by dialer.
+func copySession(conn net.Conn, dialer *meek.Dialer) error {
+	remote, err := dialer.Dial()
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	// Copy in both directions until either one stops; the deferred Closes
+	// then stop the other.
+	errChan := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(remote, conn)
+		errChan <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, remote)
+		errChan <- err
+	}()
+	return <-errChan
 }
 
 func acceptLoop(ln *pt.SocksListener) error {
@@ -371,17 +426,95 @@ func checkProxyURL(u *url.URL) error {
 	return nil
 }
 
+// Do the managed-proxy setup with a tor parent process, and start a SOCKS
+// listener for each requested method.
+func startManaged() []net.Listener {
+	var err error
+	ptInfo, err = pt.ClientSetup([]string{ptMethodName})
+	if err != nil {
+		log.Fatalf("error in ClientSetup: %s", err)
+	}
+	ptProxyURL, err := PtGetProxyURL()
+	if err != nil {
+		PtProxyError(err.Error())
+		log.Fatalf("can't get managed proxy configuration: %s", err)
+	}
+
+	// Command-line proxy overrides managed configuration.
+	if options.ProxyURL == nil {
+		options.ProxyURL = ptProxyURL
+	}
+	// Check whether we support this kind of proxy.
+	if options.ProxyURL != nil {
+		err = checkProxyURL(options.ProxyURL)
+		if err != nil {
+			PtProxyError(err.Error())
+			log.Fatal(fmt.Sprintf("proxy error: %s", err))
+		}
+		log.Printf("using proxy %s", options.ProxyURL.String())
+		if ptProxyURL != nil {
+			PtProxyDone()
+		}
+	}
+
+	listeners := make([]net.Listener, 0)
+	for _, methodName := range ptInfo.MethodNames {
+		switch methodName {
+		case ptMethodName:
+			ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+			if err != nil {
+				pt.CmethodError(methodName, err.Error())
+				break
+			}
+			go acceptLoop(ln)
+			pt.Cmethod(methodName, ln.Version(), ln.Addr())
+			log.Printf("listening on %s", ln.Addr())
+			listeners = append(listeners, ln)
+		default:
+			pt.CmethodError(methodName, "no such method")
+		}
+	}
+	pt.CmethodsDone()
+	return listeners
+}
+
 func main() {
+	var configFilename string
 	var helperAddr string
+	var httpConnectAddr string
 	var logFilename string
+	var metricsAddr string
 	var proxy string
+	var socksAddr string
+	var statusInterval time.Duration
+	var limits limitOptions
 	var err error
 
-	flag.StringVar(&options.Front, "front", "", "front domain name if no front= SOCKS arg")
+	flag.Var(&limits.ByteBudget, "byte-budget", "most bytes to send and receive in all, with optional K, M, or G suffix (0 for no limit)")
+	flag.StringVar(&options.CAFilename, "ca", "", "file of PEM-encoded CA certificates to trust instead of the system roots if no ca= SOCKS arg")
+	flag.StringVar(&configFilename, "config", "", "configuration file of named profiles")
+	flag.StringVar(&options.ConnectTo, "connect-to", "", "comma-separated list of HOST:ADDRESS[:PORT] addresses to connect to instead of front hosts if no connect-to= SOCKS arg")
+	flag.BoolVar(&options.Debug, "debug", false, "log debugging messages")
+	flag.Var(&limits.DownloadRate, "download-rate", "download bandwidth limit in bytes per second, with optional K, M, or G suffix (0 for no limit)")
+	flag.StringVar(&options.DoH, "doh", "", "URL of DNS-over-HTTPS resolver if no doh= SOCKS arg")
+	flag.StringVar(&options.ECH, "ech", "", "base64 ECHConfigList, or \"doh\" to look it up, if no ech= SOCKS arg")
+	flag.StringVar(&options.Front, "front", "", "front domain name (or comma-separated list) if no front= SOCKS arg")
+	flag.Var(&options.Headers, "header", "extra header field \"Name: value\" if no header= SOCKS args (may be repeated)")
+	flag.StringVar(&options.HeadersFilename, "headers", "", "file of extra header fields if no headers= SOCKS arg")
 	flag.StringVar(&helperAddr, "helper", "", "address of HTTP helper (browser extension)")
+	flag.StringVar(&httpConnectAddr, "http-connect", "", "in standalone mode, address to listen on for HTTP CONNECT requests")
 	flag.StringVar(&logFilename, "log", "", "name of log file")
+	flag.StringVar(&metricsAddr, "metrics", "", "serve Prometheus metrics on this loopback address or unix:PATH")
+	flag.StringVar(&options.Pins, "pin", "", "comma-separated list of sha256/ public key pins for the front if no pin= SOCKS arg")
+	flag.StringVar(&options.Profile, "profile", "", "name of profile from --config to use if no profile= SOCKS arg")
 	flag.StringVar(&proxy, "proxy", "", "proxy URL if no proxy= SOCKS arg")
-	flag.StringVar(&options.URL, "url", "", "URL to request if no url= SOCKS arg")
+	flag.StringVar(&socksAddr, "socks", "", "in standalone mode, address to listen on for SOCKS5 requests")
+	flag.DurationVar(&statusInterval, "status-interval", 0, "log a summary of statistics this often (0 to disable)")
+	flag.StringVar(&options.Resolve, "resolve", "", "comma-separated list of HOST:ADDRESS mappings if no resolve= SOCKS arg")
+	flag.Var(&limits.UploadRate, "upload-rate", "upload bandwidth limit in bytes per second, with optional K, M, or G suffix (0 for no limit)")
+	flag.StringVar(&options.URL, "url", "", "URL (or comma-separated list) to request if no url= SOCKS arg")
+	options.Tuning = defaultTuning()
+	options.Tuning.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	if logFilename != "" {
@@ -408,51 +541,82 @@ func main() {
 		}
 	}
 
-	ptInfo, err = pt.ClientSetup([]string{ptMethodName})
+	err = options.Tuning.Check()
 	if err != nil {
-		log.Fatalf("error in ClientSetup: %s", err)
+		log.Fatalf("%s", err)
 	}
-	ptProxyURL, err := PtGetProxyURL()
+	err = limits.Check()
 	if err != nil {
-		PtProxyError(err.Error())
-		log.Fatalf("can't get managed proxy configuration: %s", err)
+		log.Fatalf("%s", err)
 	}
-
-	// Command-line proxy overrides managed configuration.
-	if options.ProxyURL == nil {
-		options.ProxyURL = ptProxyURL
+	limit = limits.ClientLimit()
+	if limit != nil {
+		log.Printf("limits: upload %d B/s, download %d B/s, budget %d bytes (0 for no limit)", limits.UploadRate, limits.DownloadRate, limits.ByteBudget)
 	}
-	// Check whether we support this kind of proxy.
-	if options.ProxyURL != nil {
-		err = checkProxyURL(options.ProxyURL)
+
+	// Check every profile now, so that mistakes show up at startup rather
+	// than when a connection is made.
+	if configFilename != "" {
+		options.Profiles, err = loadConfig(configFilename)
 		if err != nil {
-			PtProxyError(err.Error())
-			log.Fatal(fmt.Sprintf("proxy error: %s", err))
+			log.Fatalf("error loading configuration: %s", err)
 		}
-		log.Printf("using proxy %s", options.ProxyURL.String())
-		if ptProxyURL != nil {
-			PtProxyDone()
+		for _, name := range profileNames(options.Profiles) {
+			args := connArgs{profile: options.Profiles[name]}
+			_, err = makeDialer(&args, "0.0.2.0:1", true)
+			if err != nil {
+				log.Fatalf("error in profile %q: %s", name, err)
+			}
+		}
+		log.Printf("loaded %d profiles from %s", len(options.Profiles), configFilename)
+	}
+	if options.Profile != "" {
+		_, ok := options.Profiles[options.Profile]
+		if !ok {
+			log.Fatalf("no profile named %q", options.Profile)
 		}
 	}
 
-	listeners := make([]net.Listener, 0)
-	for _, methodName := range ptInfo.MethodNames {
-		switch methodName {
-		case ptMethodName:
-			ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+	if statusInterval < 0 {
+		log.Fatalf("--status-interval must not be negative")
+	}
+	if metricsAddr != "" || statusInterval > 0 {
+		metrics = meek.NewClientMetrics()
+	}
+	if metricsAddr != "" {
+		ln, err := meek.ListenMetrics(metricsAddr, metrics, log.Printf)
+		if err != nil {
+			log.Fatalf("error starting metrics listener: %s", err)
+		}
+		defer ln.Close()
+	}
+	if statusInterval > 0 {
+		go logStatusLoop(metrics, statusInterval)
+	}
+
+	var listeners []net.Listener
+	if socksAddr != "" || httpConnectAddr != "" {
+		// Standalone mode needs a URL, because there is no bridge line
+		// to supply one.
+		args := connArgs{profile: options.Profiles[options.Profile]}
+		_, ok := args.get("url", options.URL)
+		if !ok {
+			log.Fatalf("standalone mode needs --url or a --profile with a url")
+		}
+		if options.ProxyURL != nil {
+			err = checkProxyURL(options.ProxyURL)
 			if err != nil {
-				pt.CmethodError(methodName, err.Error())
-				break
+				log.Fatalf("proxy error: %s", err)
 			}
-			go acceptLoop(ln)
-			pt.Cmethod(methodName, ln.Version(), ln.Addr())
-			log.Printf("listening on %s", ln.Addr())
-			listeners = append(listeners, ln)
-		default:
-			pt.CmethodError(methodName, "no such method")
+			log.Printf("using proxy %s", options.ProxyURL.String())
+		}
+		listeners, err = startStandalone(socksAddr, httpConnectAddr)
+		if err != nil {
+			log.Fatalf("error starting standalone listeners: %s", err)
 		}
+	} else {
+		listeners = startManaged()
 	}
-	pt.CmethodsDone()
 
 	var numHandlers int = 0
 	var sig os.Signal
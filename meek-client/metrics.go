@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+// The code in this file has to do with statistics about sessions and fronts:
+// how many requests and retries there have been, how many bytes have gone each
+// way, percentiles of roundtrip time, and the current poll interval. They help
+// to tell why a connection is slow. With --status-interval, a summary is
+// logged periodically; with --metrics, the statistics are served in the
+// Prometheus text format at /metrics on a loopback address or Unix socket:
+// 	meek-client --status-interval=10m --metrics=127.0.0.1:9101
+// Sessions are identified by a hash of their session id.
+
+// Statistics for all sessions; nil unless --metrics or --status-interval was
+// given.
+var metrics *meek.ClientMetrics
+
+// Log a summary of m every interval, forever.
+func logStatusLoop(m *meek.ClientMetrics, interval time.Duration) {
+	for range time.Tick(interval) {
+		m.LogSummary(log.Printf)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+// The code in this file has to do with splitting one session across several
+// paths (combinations of URL and front domain). Requests on different paths may
+// be in flight at the same time; each carries an X-Session-Seq header so that
+// meek-server can process them in the order they were sent. The meek package
+// does the sending; this file only turns the url and front options into paths.
+
+// Split a comma-separated list, ignoring surrounding whitespace and empty
+// elements.
+func splitList(s string) []string {
+	var list []string
+	for _, elem := range strings.Split(s, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem != "" {
+			list = append(list, elem)
+		}
+	}
+	return list
+}
+
+// Make one meek.Path for each combination formed by pairing up urls and fronts.
+// If both lists have more than one element, they must be the same length and
+// are paired element by element. Otherwise a single URL is used with every
+// front, or a single front with every URL. fronts may be empty, meaning no
+// fronting.
+func makePaths(urls, fronts []string) ([]meek.Path, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no URL given")
+	}
+	n := len(urls)
+	if len(fronts) > n {
+		n = len(fronts)
+	}
+	if len(urls) > 1 && len(fronts) > 1 && len(urls) != len(fronts) {
+		return nil, errors.New(fmt.Sprintf("can't pair %d URLs with %d fronts", len(urls), len(fronts)))
+	}
+
+	paths := make([]meek.Path, n)
+	for i := 0; i < n; i++ {
+		var err error
+		paths[i].URL, err = url.Parse(urls[i%len(urls)])
+		if err != nil {
+			return nil, err
+		}
+		if len(fronts) > 0 {
+			paths[i].Front = fronts[i%len(fronts)]
+		}
+	}
+
+	return paths, nil
+}
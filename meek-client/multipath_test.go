@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSplitList(t *testing.T) {
+	tests := [...]struct {
+		input    string
+		expected []string
+	}{
+		{"", nil},
+		{",", nil},
+		{"a", []string{"a"}},
+		{"a,b", []string{"a", "b"}},
+		{" a , b ,, c ", []string{"a", "b", "c"}},
+	}
+
+	for _, test := range tests {
+		output := splitList(test.input)
+		if len(output) != len(test.expected) {
+			t.Errorf("%q → %q (expected %q)", test.input, output, test.expected)
+			continue
+		}
+		for i := range output {
+			if output[i] != test.expected[i] {
+				t.Errorf("%q → %q (expected %q)", test.input, output, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestMakePaths(t *testing.T) {
+	badTests := [...]struct {
+		urls, fronts []string
+	}{
+		{nil, nil},
+		{nil, []string{"front.example"}},
+		{[]string{"https://a.example/", "https://b.example/"}, []string{"x.example", "y.example", "z.example"}},
+		{[]string{"%"}, nil},
+	}
+	goodTests := [...]struct {
+		urls, fronts []string
+		expected     [][2]string
+	}{
+		{
+			[]string{"https://a.example/"},
+			nil,
+			[][2]string{{"https://a.example/", ""}},
+		},
+		{
+			[]string{"https://a.example/"},
+			[]string{"x.example"},
+			[][2]string{{"https://a.example/", "x.example"}},
+		},
+		{
+			[]string{"https://a.example/"},
+			[]string{"x.example", "y.example"},
+			[][2]string{{"https://a.example/", "x.example"}, {"https://a.example/", "y.example"}},
+		},
+		{
+			[]string{"https://a.example/", "https://b.example/"},
+			[]string{"x.example"},
+			[][2]string{{"https://a.example/", "x.example"}, {"https://b.example/", "x.example"}},
+		},
+		{
+			[]string{"https://a.example/", "https://b.example/"},
+			[]string{"x.example", "y.example"},
+			[][2]string{{"https://a.example/", "x.example"}, {"https://b.example/", "y.example"}},
+		},
+	}
+
+	for _, test := range badTests {
+		_, err := makePaths(test.urls, test.fronts)
+		if err == nil {
+			t.Errorf("%q %q unexpectedly succeeded", test.urls, test.fronts)
+		}
+	}
+
+	for _, test := range goodTests {
+		paths, err := makePaths(test.urls, test.fronts)
+		if err != nil {
+			t.Errorf("%q %q unexpectedly returned an error: %s", test.urls, test.fronts, err)
+			continue
+		}
+		if len(paths) != len(test.expected) {
+			t.Errorf("%q %q → %d paths (expected %d)", test.urls, test.fronts, len(paths), len(test.expected))
+			continue
+		}
+		for i, path := range paths {
+			if path.URL.String() != test.expected[i][0] || path.Front != test.expected[i][1] {
+				t.Errorf("%q %q path %d → %q %q (expected %q %q)", test.urls, test.fronts, i,
+					path.URL.String(), path.Front, test.expected[i][0], test.expected[i][1])
+			}
+		}
+	}
+}
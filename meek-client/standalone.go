@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// The code in this file has to do with standalone mode, in which meek-client
+// runs without a tor parent process. Instead of the managed-proxy interface,
+// it listens on a SOCKS5 address given by --socks and/or an HTTP CONNECT proxy
+// address given by --http-connect, and tunnels every connection it accepts to
+// the meek-server at --url (or the url of --profile). This makes it usable by
+// programs other than tor, and in tests:
+// 	meek-client --socks=127.0.0.1:1080 --url=https://meek.example.com/
+// Each connection becomes a new meek session. The target address requested by
+// the SOCKS or CONNECT client is sent to the server with the session; a server
+// with --forward ignores it and connects every session to the same place, while
+// one with --allow connects to the target if its allowlist permits.
+// Per-connection options come from the command line and --profile, as there
+// are no SOCKS args.
+
+// SOCKS5 constants from RFC 1928.
+const (
+	socks5Version          = 0x05
+	socks5AuthNone         = 0x00
+	socks5AuthNoAcceptable = 0xff
+	socks5CmdConnect       = 0x01
+	socks5AtypIPv4         = 0x01
+	socks5AtypDomainName   = 0x03
+	socks5AtypIPv6         = 0x04
+
+	socks5Succeeded               = 0x00
+	socks5GeneralFailure          = 0x01
+	socks5CommandNotSupported     = 0x07
+	socks5AddressTypeNotSupported = 0x08
+)
+
+// Read a SOCKS5 method negotiation and request from conn, and return the
+// requested target as "host:port". Only the "no authentication required"
+// method and the CONNECT command are supported. On error, an appropriate reply
+// has already been sent. On success, the caller must send a reply with
+// socks5Reply.
+func socks5ReadRequest(conn io.ReadWriter) (string, error) {
+	var buf [255]byte
+
+	// Version identifier/method selection.
+	_, err := io.ReadFull(conn, buf[:2])
+	if err != nil {
+		return "", err
+	}
+	if buf[0] != socks5Version {
+		return "", errors.New(fmt.Sprintf("SOCKS version %d is not %d", buf[0], socks5Version))
+	}
+	nmethods := int(buf[1])
+	_, err = io.ReadFull(conn, buf[:nmethods])
+	if err != nil {
+		return "", err
+	}
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range buf[:nmethods] {
+		if m == socks5AuthNone {
+			method = socks5AuthNone
+		}
+	}
+	_, err = conn.Write([]byte{socks5Version, method})
+	if err != nil {
+		return "", err
+	}
+	if method == socks5AuthNoAcceptable {
+		return "", errors.New("no acceptable SOCKS authentication method")
+	}
+
+	// Request.
+	_, err = io.ReadFull(conn, buf[:4])
+	if err != nil {
+		return "", err
+	}
+	if buf[0] != socks5Version {
+		return "", errors.New(fmt.Sprintf("SOCKS version %d is not %d", buf[0], socks5Version))
+	}
+	cmd, atyp := buf[1], buf[3]
+	var host string
+	switch atyp {
+	case socks5AtypIPv4:
+		_, err = io.ReadFull(conn, buf[:net.IPv4len])
+		host = net.IP(buf[:net.IPv4len]).String()
+	case socks5AtypIPv6:
+		_, err = io.ReadFull(conn, buf[:net.IPv6len])
+		host = net.IP(buf[:net.IPv6len]).String()
+	case socks5AtypDomainName:
+		_, err = io.ReadFull(conn, buf[:1])
+		if err == nil {
+			n := int(buf[0])
+			_, err = io.ReadFull(conn, buf[:n])
+			host = string(buf[:n])
+		}
+	default:
+		socks5Reply(conn, socks5AddressTypeNotSupported)
+		return "", errors.New(fmt.Sprintf("unknown SOCKS address type %d", atyp))
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = io.ReadFull(conn, buf[:2])
+	if err != nil {
+		return "", err
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+	if cmd != socks5CmdConnect {
+		socks5Reply(conn, socks5CommandNotSupported)
+		return "", errors.New(fmt.Sprintf("unsupported SOCKS command %d", cmd))
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// Send a SOCKS5 reply with the given code and a bound address of 0.0.0.0:0.
+func socks5Reply(conn io.Writer, code byte) error {
+	_, err := conn.Write([]byte{socks5Version, code, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// A net.Conn whose reads come through a bufio.Reader, for when some of the
+// stream may already have been buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Read an HTTP CONNECT request from conn, and return the requested target and
+// a net.Conn to use in place of conn. On error, an appropriate response has
+// already been sent. On success, the caller must send a response.
+func httpConnectReadRequest(conn net.Conn) (net.Conn, string, error) {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if req.Method != "CONNECT" {
+		io.WriteString(conn, "HTTP/1.0 405 Method Not Allowed\r\nAllow: CONNECT\r\n\r\n")
+		return nil, "", errors.New(fmt.Sprintf("HTTP method %s is not CONNECT", req.Method))
+	}
+	_, _, err = net.SplitHostPort(req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.0 400 Bad Request\r\n\r\n")
+		return nil, "", err
+	}
+	return &bufferedConn{conn, r}, req.Host, nil
+}
+
+// Handle a connection to the SOCKS5 listener.
+func socksHandler(conn net.Conn) error {
+	handlerChan <- 1
+	defer func() {
+		handlerChan <- -1
+	}()
+
+	defer conn.Close()
+	target, err := socks5ReadRequest(conn)
+	if err != nil {
+		return err
+	}
+	dialer, err := sessionDialer(nil, target, true)
+	if err != nil {
+		socks5Reply(conn, socks5GeneralFailure)
+		return err
+	}
+	err = socks5Reply(conn, socks5Succeeded)
+	if err != nil {
+		return err
+	}
+	return copySession(conn, dialer)
+}
+
+// Handle a connection to the HTTP CONNECT listener.
+func httpConnectHandler(conn net.Conn) error {
+	handlerChan <- 1
+	defer func() {
+		handlerChan <- -1
+	}()
+
+	defer conn.Close()
+	bconn, target, err := httpConnectReadRequest(conn)
+	if err != nil {
+		return err
+	}
+	dialer, err := sessionDialer(nil, target, true)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.0 502 Bad Gateway\r\n\r\n")
+		return err
+	}
+	_, err = io.WriteString(conn, "HTTP/1.0 200 Connection established\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	return copySession(bconn, dialer)
+}
+
+func standaloneAcceptLoop(ln net.Listener, handler func(net.Conn) error) error {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("error in Accept: %s", err)
+			if e, ok := err.(net.Error); ok && !e.Temporary() {
+				return err
+			}
+			continue
+		}
+		go func() {
+			err := handler(conn)
+			if err != nil {
+				log.Printf("error in handling request: %s", err)
+			}
+		}()
+	}
+}
+
+// Start the standalone listeners on the non-empty addresses among socksAddr and
+// httpConnectAddr.
+func startStandalone(socksAddr, httpConnectAddr string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, l := range []struct {
+		name    string
+		addr    string
+		handler func(net.Conn) error
+	}{
+		{"SOCKS5", socksAddr, socksHandler},
+		{"HTTP CONNECT", httpConnectAddr, httpConnectHandler},
+	} {
+		if l.addr == "" {
+			continue
+		}
+		ln, err := net.Listen("tcp", l.addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		go standaloneAcceptLoop(ln, l.handler)
+		log.Printf("listening for %s on %s", l.name, ln.Addr())
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
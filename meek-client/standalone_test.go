@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// A fake connection that reads from a fixed input and records what is written.
+type fakeRW struct {
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (rw *fakeRW) Read(p []byte) (int, error) {
+	return rw.r.Read(p)
+}
+
+func (rw *fakeRW) Write(p []byte) (int, error) {
+	return rw.w.Write(p)
+}
+
+func TestSocks5ReadRequest(t *testing.T) {
+	tests := []struct {
+		input    []byte
+		target   string
+		expected []byte
+	}{
+		// IPv4.
+		{
+			[]byte{5, 1, 0, 5, 1, 0, 1, 192, 0, 2, 1, 0x01, 0xbb},
+			"192.0.2.1:443",
+			[]byte{5, 0},
+		},
+		// Domain name, with several offered methods.
+		{
+			append(append([]byte{5, 2, 2, 0, 5, 1, 0, 3, 11}, "example.com"...), 0, 80),
+			"example.com:80",
+			[]byte{5, 0},
+		},
+		// IPv6.
+		{
+			[]byte{5, 1, 0, 5, 1, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 22},
+			"[2001:db8::1]:22",
+			[]byte{5, 0},
+		},
+	}
+	for _, test := range tests {
+		rw := &fakeRW{r: bytes.NewReader(test.input)}
+		target, err := socks5ReadRequest(rw)
+		if err != nil {
+			t.Errorf("%x: %s", test.input, err)
+			continue
+		}
+		if target != test.target {
+			t.Errorf("%x: target %q (expected %q)", test.input, target, test.target)
+		}
+		if !bytes.Equal(rw.w.Bytes(), test.expected) {
+			t.Errorf("%x: wrote %x (expected %x)", test.input, rw.w.Bytes(), test.expected)
+		}
+	}
+
+	badTests := []struct {
+		input    []byte
+		expected []byte
+	}{
+		// SOCKS4.
+		{[]byte{4, 1, 0, 80, 192, 0, 2, 1, 0}, []byte{}},
+		// No acceptable method.
+		{[]byte{5, 1, 2}, []byte{5, 0xff}},
+		// BIND command.
+		{[]byte{5, 1, 0, 5, 2, 0, 1, 192, 0, 2, 1, 0, 80}, []byte{5, 0, 5, 7, 0, 1, 0, 0, 0, 0, 0, 0}},
+		// Unknown address type.
+		{[]byte{5, 1, 0, 5, 1, 0, 9}, []byte{5, 0, 5, 8, 0, 1, 0, 0, 0, 0, 0, 0}},
+		// Truncated.
+		{[]byte{5, 1, 0, 5, 1, 0, 1, 192, 0}, []byte{5, 0}},
+	}
+	for _, test := range badTests {
+		rw := &fakeRW{r: bytes.NewReader(test.input)}
+		_, err := socks5ReadRequest(rw)
+		if err == nil {
+			t.Errorf("%x: unexpected success", test.input)
+		}
+		if !bytes.Equal(rw.w.Bytes(), test.expected) {
+			t.Errorf("%x: wrote %x (expected %x)", test.input, rw.w.Bytes(), test.expected)
+		}
+	}
+}
+
+func TestHTTPConnectReadRequest(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		io.WriteString(c2, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\nearly data")
+	}()
+	conn, target, err := httpConnectReadRequest(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "example.com:443" {
+		t.Errorf("target %q", target)
+	}
+	// Data sent right after the request must not be lost.
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "early data" {
+		t.Errorf("read %q", buf)
+	}
+	c2.Close()
+
+	c1, c2 = net.Pipe()
+	defer c1.Close()
+	go func() {
+		io.WriteString(c2, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	}()
+	done := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(c2).ReadString('\n')
+		done <- line
+	}()
+	_, _, err = httpConnectReadRequest(c1)
+	if err == nil {
+		t.Errorf("GET: unexpected success")
+	}
+	line := <-done
+	if !strings.Contains(line, " 405 ") {
+		t.Errorf("GET: response %q", line)
+	}
+}
+
+// A configuration error is reported to the SOCKS or HTTP CONNECT client as a
+// failure, not as a success followed by a close.
+func TestStandaloneBadConfig(t *testing.T) {
+	saved := options.Profile
+	options.Profile = "missing"
+	defer func() {
+		options.Profile = saved
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-handlerChan:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	tests := []struct {
+		handler  func(net.Conn) error
+		input    []byte
+		expected []byte
+	}{
+		{
+			socksHandler,
+			[]byte{5, 1, 0, 5, 1, 0, 1, 192, 0, 2, 1, 0x01, 0xbb},
+			[]byte{5, 0, 5, socks5GeneralFailure, 0, 1, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			httpConnectHandler,
+			[]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"),
+			[]byte("HTTP/1.0 502 Bad Gateway\r\n\r\n"),
+		},
+	}
+	for _, test := range tests {
+		c1, c2 := net.Pipe()
+		go c2.Write(test.input)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- test.handler(c1)
+		}()
+		output, _ := ioutil.ReadAll(c2)
+		c2.Close()
+		if !bytes.Equal(output, test.expected) {
+			t.Errorf("%q: response %q (expected %q)", test.input, output, test.expected)
+		}
+		if err := <-errChan; err == nil {
+			t.Errorf("%q: unexpected success", test.input)
+		}
+	}
+}
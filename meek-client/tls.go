@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+// The code in this file has to do with controlling which certificates we
+// accept from the front, beyond what the system trust store says. A custom CA
+// bundle replaces the system roots, and pins further restrict the verified
+// chain to one containing a given public key. Both fail closed: a front that
+// doesn't match causes the roundtrip to fail rather than fall back.
+
+// Pins are given in the same form as HTTP Public Key Pinning: "sha256/"
+// followed by the base64-encoded SHA-256 digest of a certificate's
+// DER-encoded SubjectPublicKeyInfo.
+const pinPrefix = "sha256/"
+
+// Parse a comma-separated list of pins, returning the digests they contain.
+func parsePins(s string) ([][sha256.Size]byte, error) {
+	var pins [][sha256.Size]byte
+	for _, elem := range splitList(s) {
+		if !strings.HasPrefix(elem, pinPrefix) {
+			return nil, errors.New(fmt.Sprintf("pin %q doesn't start with %q", elem, pinPrefix))
+		}
+		digest, err := base64.StdEncoding.DecodeString(elem[len(pinPrefix):])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("pin %q: %s", elem, err))
+		}
+		if len(digest) != sha256.Size {
+			return nil, errors.New(fmt.Sprintf("pin %q has length %d, not %d", elem, len(digest), sha256.Size))
+		}
+		var pin [sha256.Size]byte
+		copy(pin[:], digest)
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// Read a file of PEM-encoded CA certificates.
+func loadCAFile(filename string) (*x509.CertPool, error) {
+	pemCerts, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, errors.New(fmt.Sprintf("no certificates found in %s", filename))
+	}
+	return pool, nil
+}
+
+// Make a tls.Config from a CA bundle filename and a list of pins, either of
+// which may be empty. Returns nil if both are empty, meaning to use the
+// default configuration.
+func makeTLSConfig(caFilename, pinList string) (*tls.Config, error) {
+	if caFilename == "" && pinList == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if caFilename != "" {
+		pool, err := loadCAFile(caFilename)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if pinList != "" {
+		pins, err := parsePins(pinList)
+		if err != nil {
+			return nil, err
+		}
+		if len(pins) == 0 {
+			return nil, errors.New("empty pin list")
+		}
+		config.VerifyPeerCertificate = meek.VerifyPins(pins)
+	}
+	return config, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+func TestParsePins(t *testing.T) {
+	badTests := [...]string{
+		"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		"sha1/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU",
+		"sha256/2jmj7l5rSw0yVb/vlWAYkK/YBwk=",
+		"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=,bogus",
+	}
+	goodTests := [...]struct {
+		input    string
+		expected int
+	}{
+		{"", 0},
+		{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", 1},
+		{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=, sha256/7HIpactkIAq2Y49orFOOQKurWxmmSFZhBCoQYcRhJ3Y=", 2},
+	}
+
+	for _, input := range badTests {
+		_, err := parsePins(input)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+
+	for _, test := range goodTests {
+		pins, err := parsePins(test.input)
+		if err != nil {
+			t.Errorf("%q unexpectedly returned an error: %s", test.input, err)
+			continue
+		}
+		if len(pins) != test.expected {
+			t.Errorf("%q → %d pins (expected %d)", test.input, len(pins), test.expected)
+		}
+	}
+}
+
+func TestMakeTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	// Write the server's self-signed certificate to a CA bundle.
+	f, err := ioutil.TempFile("", "meek-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	err = pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pin := meek.CertPin(server.Certificate())
+	goodPin := pinPrefix + base64.StdEncoding.EncodeToString(pin[:])
+	badPin := pinPrefix + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := [...]struct {
+		caFilename, pins string
+		ok               bool
+	}{
+		// The test server's certificate isn't in the system roots.
+		{"", "", false},
+		{f.Name(), "", true},
+		{f.Name(), goodPin, true},
+		{f.Name(), badPin + "," + goodPin, true},
+		{f.Name(), badPin, false},
+	}
+
+	for _, test := range tests {
+		config, err := makeTLSConfig(test.caFilename, test.pins)
+		if err != nil {
+			t.Errorf("%q %q unexpectedly returned an error: %s", test.caFilename, test.pins, err)
+			continue
+		}
+		tr := &http.Transport{TLSClientConfig: config}
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := tr.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%q %q: roundtrip returned %v", test.caFilename, test.pins, err)
+		}
+	}
+
+	_, err = makeTLSConfig("/nonexistent", "")
+	if err == nil {
+		t.Errorf("nonexistent CA file unexpectedly succeeded")
+	}
+}
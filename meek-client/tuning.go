@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+// The code in this file has to do with the polling and retry parameters, which
+// may be set per bridge with SOCKS args (or in a profile, or on the command
+// line), because what works well for one CDN may not for another:
+// 	Bridge meek 0.0.2.0:1 url=https://meek.example.com/ init-poll-interval=50ms max-poll-interval=2s max-tries=3 retry-delay=5s
+
+// Bounds on the parameters, to protect against typos that would make meek
+// either flood the server or hang.
+const (
+	minPollInterval           = 1 * time.Millisecond
+	maxMaxPollInterval        = 10 * time.Minute
+	minPollIntervalMultiplier = 1.0
+	maxPollIntervalMultiplier = 10.0
+	maxMaxTries               = 100
+	maxMaxRetryDelay          = 10 * time.Minute
+	maxRetryDeadline          = 1 * time.Hour
+)
+
+// Polling and retry parameters. This is the same as meek.Tuning, but with
+// methods for setting the parameters from options and checking their bounds.
+type Tuning meek.Tuning
+
+func defaultTuning() Tuning {
+	return Tuning(meek.DefaultTuning())
+}
+
+// The names of the parameters, as SOCKS args and command line options.
+var tuningKeys = []string{
+	"init-poll-interval",
+	"max-poll-interval",
+	"poll-interval-multiplier",
+	"max-tries",
+	"retry-delay",
+	"max-retry-delay",
+	"retry-deadline",
+}
+
+// Register command line options for the fields of tuning.
+func (tuning *Tuning) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&tuning.InitPollInterval, "init-poll-interval", tuning.InitPollInterval, "first polling interval when idle if no init-poll-interval= SOCKS arg")
+	fs.DurationVar(&tuning.MaxPollInterval, "max-poll-interval", tuning.MaxPollInterval, "maximum polling interval if no max-poll-interval= SOCKS arg")
+	fs.Float64Var(&tuning.PollIntervalMultiplier, "poll-interval-multiplier", tuning.PollIntervalMultiplier, "growth of polling interval when idle if no poll-interval-multiplier= SOCKS arg")
+	fs.IntVar(&tuning.MaxTries, "max-tries", tuning.MaxTries, "number of tries for each HTTP request if no max-tries= SOCKS arg")
+	fs.DurationVar(&tuning.RetryDelay, "retry-delay", tuning.RetryDelay, "delay before the first retry if no retry-delay= SOCKS arg")
+	fs.DurationVar(&tuning.MaxRetryDelay, "max-retry-delay", tuning.MaxRetryDelay, "maximum delay between tries if no max-retry-delay= SOCKS arg")
+	fs.DurationVar(&tuning.RetryDeadline, "retry-deadline", tuning.RetryDeadline, "time after the first try beyond which not to retry if no retry-deadline= SOCKS arg")
+}
+
+// Set the parameter called key from its string representation.
+func (tuning *Tuning) Set(key, value string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	tuning.RegisterFlags(fs)
+	if fs.Lookup(key) == nil {
+		return errors.New(fmt.Sprintf("unknown option %q", key))
+	}
+	err := fs.Set(key, value)
+	if err != nil {
+		return errors.New(fmt.Sprintf("bad value %q for %s: %s", value, key, err))
+	}
+	return nil
+}
+
+// Return an error if any parameter is out of bounds.
+func (tuning *Tuning) Check() error {
+	if tuning.MaxPollInterval < minPollInterval || tuning.MaxPollInterval > maxMaxPollInterval {
+		return errors.New(fmt.Sprintf("max-poll-interval must be between %s and %s", minPollInterval, maxMaxPollInterval))
+	}
+	if tuning.InitPollInterval < minPollInterval || tuning.InitPollInterval > tuning.MaxPollInterval {
+		return errors.New(fmt.Sprintf("init-poll-interval must be between %s and max-poll-interval", minPollInterval))
+	}
+	if !(tuning.PollIntervalMultiplier >= minPollIntervalMultiplier && tuning.PollIntervalMultiplier <= maxPollIntervalMultiplier) {
+		return errors.New(fmt.Sprintf("poll-interval-multiplier must be between %s and %s",
+			strconv.FormatFloat(minPollIntervalMultiplier, 'f', -1, 64), strconv.FormatFloat(maxPollIntervalMultiplier, 'f', -1, 64)))
+	}
+	if tuning.MaxTries < 1 || tuning.MaxTries > maxMaxTries {
+		return errors.New(fmt.Sprintf("max-tries must be between 1 and %d", maxMaxTries))
+	}
+	if tuning.MaxRetryDelay < 0 || tuning.MaxRetryDelay > maxMaxRetryDelay {
+		return errors.New(fmt.Sprintf("max-retry-delay must be between 0 and %s", maxMaxRetryDelay))
+	}
+	if tuning.RetryDelay < 0 || tuning.RetryDelay > tuning.MaxRetryDelay {
+		return errors.New("retry-delay must be between 0 and max-retry-delay")
+	}
+	if tuning.RetryDeadline < 0 || tuning.RetryDeadline > maxRetryDeadline {
+		return errors.New(fmt.Sprintf("retry-deadline must be between 0 and %s", maxRetryDeadline))
+	}
+	return nil
+}
+
+// Make the Tuning for a connection, starting from the command line options
+// and overriding them with any SOCKS args or profile options.
+func makeTuning(args *connArgs) (*Tuning, error) {
+	tuning := options.Tuning
+	for _, key := range tuningKeys {
+		value, ok := args.get(key, "")
+		if ok {
+			err := tuning.Set(key, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err := tuning.Check()
+	if err != nil {
+		return nil, err
+	}
+	return &tuning, nil
+}
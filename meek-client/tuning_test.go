@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+
+func TestMakeTuning(t *testing.T) {
+	options.Tuning = defaultTuning()
+
+	badTests := [...]map[string]string{
+		{"init-poll-interval": "x"},
+		{"init-poll-interval": "0"},
+		{"init-poll-interval": "10s"},
+		{"max-poll-interval": "0"},
+		{"max-poll-interval": "1h"},
+		{"poll-interval-multiplier": "0.5"},
+		{"poll-interval-multiplier": "NaN"},
+		{"poll-interval-multiplier": "100"},
+		{"max-tries": "0"},
+		{"max-tries": "1000"},
+		{"retry-delay": "-1s"},
+		{"retry-delay": "1h"},
+	}
+
+	for _, test := range badTests {
+		socks := pt.Args{}
+		for key, value := range test {
+			socks.Add(key, value)
+		}
+		_, err := makeTuning(&connArgs{socks: socks})
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", test)
+		}
+	}
+
+	socks := pt.Args{}
+	socks.Add("init-poll-interval", "50ms")
+	socks.Add("max-tries", "3")
+	profile := pt.Args{}
+	profile.Add("max-tries", "5")
+	profile.Add("retry-delay", "5s")
+	tuning, err := makeTuning(&connArgs{socks: socks, profile: profile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := defaultTuning()
+	expected.InitPollInterval = 50 * time.Millisecond
+	expected.MaxTries = 3
+	expected.RetryDelay = 5 * time.Second
+	if *tuning != expected {
+		t.Errorf("→ %+v (expected %+v)", *tuning, expected)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+import "golang.org/x/crypto/acme"
+import "golang.org/x/crypto/acme/autocert"
+
+// The code in this file has to do with ACME mode, in which meek-server gets
+// its TLS certificates automatically from an ACME certificate authority such
+// as Let's Encrypt, instead of from --cert and --key, and renews them before
+// they expire:
+// 	./meek-server --port 443 --acme-hostnames meek.example.com --acme-email admin@example.com
+// A certificate is requested the first time a client asks for one of the
+// hostnames. The CA checks that the server controls the name by one of two
+// challenges: TLS-ALPN-01, which is answered on the HTTPS listener itself and
+// so needs it to be reachable on port 443; or HTTP-01, which is answered on a
+// separate plain-HTTP listener given by --acme-http, which needs to be
+// reachable on port 80. Certificates and the account key are kept in
+// --acme-cache, which defaults to a directory under TOR_PT_STATE_LOCATION in
+// managed mode. Using ACME mode means agreeing to the CA's terms of service.
+//
+// --acme-directory and --acme-ca point meek-server at a different CA, for
+// example a local Pebble test server (https://github.com/letsencrypt/pebble):
+// 	./meek-server --listen :5001 --forward 127.0.0.1:7 --acme-hostnames meek.test --acme-http :5002 --acme-cache /tmp/acme --acme-directory https://127.0.0.1:14000/dir --acme-ca pebble.minica.pem
+
+// ACME mode's certificates; nil unless --acme-hostnames was given.
+var acmeCerts *acmeCertificates
+
+// The ACME options.
+type acmeOptions struct {
+	Hostnames  string
+	Email      string
+	Directory  string
+	CAFilename string
+	CacheDir   string
+	HTTPAddr   string
+}
+
+// Register command line options for the fields of opts.
+func (opts *acmeOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.Hostnames, "acme-hostnames", "", "get certificates from an ACME CA for this comma-separated list of hostnames, instead of using --cert and --key")
+	fs.StringVar(&opts.Email, "acme-email", "", "contact address to give the ACME CA")
+	fs.StringVar(&opts.Directory, "acme-directory", acme.LetsEncryptURL, "directory URL of the ACME CA")
+	fs.StringVar(&opts.CAFilename, "acme-ca", "", "file of PEM-encoded CA certificates to trust for the ACME CA's own HTTPS, for testing")
+	fs.StringVar(&opts.CacheDir, "acme-cache", "", "directory to keep ACME certificates and keys in (default under TOR_PT_STATE_LOCATION)")
+	fs.StringVar(&opts.HTTPAddr, "acme-http", "", "address to listen on for ACME HTTP-01 challenges")
+}
+
+// Return the list of hostnames, or an error if there is a bad one.
+func (opts *acmeOptions) hostnames() ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(opts.Hostnames, ",") {
+		name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+		if name == "" {
+			continue
+		}
+		if !strings.Contains(name, ".") || strings.ContainsAny(name, " \t/:[]*") || net.ParseIP(name) != nil {
+			return nil, errors.New(fmt.Sprintf("bad ACME hostname %q", name))
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no ACME hostnames")
+	}
+	return names, nil
+}
+
+// An autocert.Manager for a fixed list of hostnames. Handshakes that don't name
+// a server get the certificate of the first hostname.
+type acmeCertificates struct {
+	manager     *autocert.Manager
+	defaultName string
+}
+
+// Make the acmeCertificates for opts, keeping its files in cacheDir.
+func newACMECertificates(opts *acmeOptions, cacheDir string) (*acmeCertificates, error) {
+	names, err := opts.hostnames()
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{DirectoryURL: opts.Directory}
+	if opts.CAFilename != "" {
+		data, err := ioutil.ReadFile(opts.CAFilename)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, errors.New(fmt.Sprintf("no certificates found in %s", opts.CAFilename))
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	return &acmeCertificates{
+		manager: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: autocert.HostWhitelist(names...),
+			Client:     client,
+			Email:      opts.Email,
+		},
+		defaultName: names[0],
+	}, nil
+}
+
+// The GetCertificate function of a tls.Config.
+func (certs *acmeCertificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		h := *hello
+		h.ServerName = certs.defaultName
+		hello = &h
+	}
+	cert, err := certs.manager.GetCertificate(hello)
+	if err != nil {
+		log.Printf("error getting ACME certificate for %q: %s", hello.ServerName, err)
+	}
+	return cert, err
+}
+
+// Set up config to use the certificates, and to answer TLS-ALPN-01
+// challenges.
+func (certs *acmeCertificates) configureTLS(config *tls.Config) {
+	config.GetCertificate = certs.GetCertificate
+	config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+}
+
+// Start answering HTTP-01 challenges on addr. Other requests are redirected to
+// HTTPS.
+func (certs *acmeCertificates) startHTTP(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("listening for ACME HTTP-01 challenges on %s", ln.Addr())
+	go func() {
+		err := http.Serve(ln, certs.manager.HTTPHandler(nil))
+		if err != nil {
+			log.Printf("error in ACME HTTP Serve: %s", err)
+		}
+	}()
+	return ln, nil
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestACMEHostnames(t *testing.T) {
+	opts := acmeOptions{Hostnames: "meek.example.com, Other.Example.com.,"}
+	names, err := opts.hostnames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"meek.example.com", "other.example.com"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("→ %q (expected %q)", names, expected)
+	}
+
+	badTests := [...]string{
+		"",
+		",",
+		"localhost",
+		"192.0.2.1",
+		"meek.example.com:443",
+		"*.example.com",
+	}
+	for _, input := range badTests {
+		opts := acmeOptions{Hostnames: input}
+		_, err := opts.hostnames()
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+}
+
+// Put a certificate for name into an autocert cache directory, the way autocert
+// stores the certificates it gets.
+func writeCachedCert(dir, name string) error {
+	certPEM, keyPEM, err := makeCertPEM(name)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), append(keyPEM, certPEM...), 0600)
+}
+
+func TestACMECertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meek-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = writeCachedCert(dir, "meek.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The CA is never contacted, because the certificate is in the cache.
+	opts := acmeOptions{Hostnames: "meek.example.com,other.example.com", Directory: "https://127.0.0.1:1/dir"}
+	certs, err := newACMECertificates(&opts, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{NextProtos: []string{"http/1.1"}}
+	certs.configureTLS(config)
+	if !reflect.DeepEqual(config.NextProtos, []string{"http/1.1", "acme-tls/1"}) {
+		t.Errorf("NextProtos %q", config.NextProtos)
+	}
+
+	ecdsaSuites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	for _, serverName := range []string{"meek.example.com", ""} {
+		cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName, CipherSuites: ecdsaSuites})
+		if err != nil {
+			t.Errorf("%q → error %s", serverName, err)
+			continue
+		}
+		if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "meek.example.com" {
+			t.Errorf("%q → wrong certificate", serverName)
+		}
+	}
+	_, err = config.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example.com", CipherSuites: ecdsaSuites})
+	if err == nil {
+		t.Errorf("certificate for an unconfigured hostname")
+	}
+}
+
+func TestACMEHTTP(t *testing.T) {
+	opts := acmeOptions{Hostnames: "meek.example.com", Directory: "https://127.0.0.1:1/dir"}
+	certs, err := newACMECertificates(&opts, os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := certs.startHTTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		// There is no challenge in progress.
+		{"/.well-known/acme-challenge/token", http.StatusNotFound},
+		// Anything else is redirected to HTTPS.
+		{"/", http.StatusFound},
+	} {
+		req, err := http.NewRequest("GET", "http://"+ln.Addr().String()+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "meek.example.com"
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s → %d (expected %d)", test.path, resp.StatusCode, test.status)
+		}
+	}
+}
+
+// A minimal ACME CA (RFC 8555) for testing: enough of the protocol for
+// autocert to get a certificate for one name at a time by HTTP-01. It doesn't
+// check JWS signatures. It checks the challenge by asking httpAddr, with the
+// domain in the Host header, for the key authorization.
+type testACMEServer struct {
+	*httptest.Server
+	httpAddr string
+
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+
+	lock     sync.Mutex
+	nonce    int
+	domain   string
+	status   string
+	token    string
+	certPEM  []byte
+	verified int
+}
+
+func newTestACMEServer() (*testACMEServer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "meek test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	ca := &testACMEServer{key: key, cert: cert}
+	ca.Server = httptest.NewTLSServer(http.HandlerFunc(ca.handle))
+	return ca, nil
+}
+
+// Decode the payload of a JWS request body into v, unless it is empty (a
+// POST-as-GET).
+func decodeJWSPayload(r io.Reader, v interface{}) error {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	err := json.NewDecoder(r).Decode(&jws)
+	if err != nil {
+		return err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil || len(payload) == 0 {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// The JSON of the current order.
+func (ca *testACMEServer) order() interface{} {
+	order := map[string]interface{}{
+		"status":         ca.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": ca.domain}},
+		"authorizations": []string{ca.URL + "/authz"},
+		"finalize":       ca.URL + "/finalize",
+	}
+	if ca.certPEM != nil {
+		order["certificate"] = ca.URL + "/cert"
+	}
+	return order
+}
+
+// The JSON of the current authorization.
+func (ca *testACMEServer) authz() interface{} {
+	status := "pending"
+	if ca.status != "pending" {
+		status = "valid"
+	}
+	return map[string]interface{}{
+		"status":     status,
+		"identifier": map[string]string{"type": "dns", "value": ca.domain},
+		"challenges": []interface{}{ca.challenge()},
+	}
+}
+
+// The JSON of the current HTTP-01 challenge.
+func (ca *testACMEServer) challenge() interface{} {
+	status := "pending"
+	if ca.status != "pending" {
+		status = "valid"
+	}
+	return map[string]string{"type": "http-01", "url": ca.URL + "/challenge", "token": ca.token, "status": status}
+}
+
+// Fetch the key authorization for the challenge from httpAddr.
+func (ca *testACMEServer) verify() error {
+	req, err := http.NewRequest("GET", "http://"+ca.httpAddr+"/.well-known/acme-challenge/"+ca.token, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = ca.domain
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), ca.token+".") {
+		return errors.New(fmt.Sprintf("bad key authorization: status %d, %q", resp.StatusCode, body))
+	}
+	return nil
+}
+
+// Issue a certificate for a DER-encoded CSR.
+func (ca *testACMEServer) issue(csrDER []byte) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...), nil
+}
+
+func (ca *testACMEServer) handle(w http.ResponseWriter, r *http.Request) {
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+	ca.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", ca.nonce))
+	w.Header().Set("Content-Type", "application/json")
+
+	var v interface{}
+	status := http.StatusOK
+	switch r.URL.Path {
+	case "/dir":
+		v = map[string]string{
+			"newNonce":   ca.URL + "/nonce",
+			"newAccount": ca.URL + "/account",
+			"newOrder":   ca.URL + "/new-order",
+			"revokeCert": ca.URL + "/revoke",
+			"keyChange":  ca.URL + "/key-change",
+		}
+	case "/nonce":
+		return
+	case "/account":
+		w.Header().Set("Location", ca.URL+"/account/1")
+		v, status = map[string]string{"status": "valid"}, http.StatusCreated
+	case "/new-order":
+		var req struct {
+			Identifiers []struct{ Value string }
+		}
+		err := decodeJWSPayload(r.Body, &req)
+		if err != nil || len(req.Identifiers) != 1 {
+			http.Error(w, "bad order", http.StatusBadRequest)
+			return
+		}
+		ca.domain, ca.status, ca.token, ca.certPEM = req.Identifiers[0].Value, "pending", fmt.Sprintf("token%d", ca.nonce), nil
+		w.Header().Set("Location", ca.URL+"/order")
+		v, status = ca.order(), http.StatusCreated
+	case "/order":
+		w.Header().Set("Location", ca.URL+"/order")
+		v = ca.order()
+	case "/authz":
+		v = ca.authz()
+	case "/challenge":
+		err := ca.verify()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		ca.verified++
+		ca.status = "ready"
+		v = ca.challenge()
+	case "/finalize":
+		var req struct {
+			CSR string
+		}
+		err := decodeJWSPayload(r.Body, &req)
+		if err != nil || ca.status != "ready" {
+			http.Error(w, "bad finalize", http.StatusBadRequest)
+			return
+		}
+		csrDER, err := base64.RawURLEncoding.DecodeString(req.CSR)
+		if err == nil {
+			ca.certPEM, err = ca.issue(csrDER)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ca.status = "valid"
+		w.Header().Set("Location", ca.URL+"/order")
+		v = ca.order()
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.certPEM)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Get a certificate from a local ACME CA, answering its HTTP-01 challenge on
+// the --acme-http listener.
+func TestACMEIssuance(t *testing.T) {
+	ca, err := newTestACMEServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ca.Close()
+	dir, err := ioutil.TempDir("", "meek-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFilename := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(caFilename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := filepath.Join(dir, "acme")
+
+	opts := acmeOptions{Hostnames: "meek.example.com", Directory: ca.URL + "/dir", CAFilename: caFilename}
+	certs, err := newACMECertificates(&opts, cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := certs.startHTTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ca.lock.Lock()
+	ca.httpAddr = ln.Addr().String()
+	ca.lock.Unlock()
+
+	ecdsaSuites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	cert, err := certs.GetCertificate(&tls.ClientHelloInfo{CipherSuites: ecdsaSuites})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "meek.example.com" || cert.Leaf.Issuer.CommonName != "meek test CA" {
+		t.Fatalf("wrong certificate %+v", cert.Leaf)
+	}
+
+	// The certificate is now in the cache, and another
+	// acmeCertificates with the same cache doesn't ask the CA again.
+	certs, err = newACMECertificates(&opts, cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "meek.example.com", CipherSuites: ecdsaSuites})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || cert.Leaf.Issuer.CommonName != "meek test CA" {
+		t.Errorf("wrong cached certificate %+v", cert.Leaf)
+	}
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+	if ca.verified != 1 {
+		t.Errorf("challenge verified %d times", ca.verified)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The code in this file has to do with reloading the --cert and --key files
+// without a restart, so that renewing a certificate doesn't drop every session.
+// The files are loaded again on SIGHUP, and whenever their modification times
+// change, which is checked every certPollInterval. New handshakes get the new
+// certificate; established connections keep going. If the files can't be
+// loaded, for example because the certificate has been replaced but the key
+// not yet, the error is logged and the old certificate stays in use until the
+// next change or SIGHUP.
+
+// How often to check whether the certificate files have changed.
+const certPollInterval = 10 * time.Second
+
+// The certificate from --cert and --key; nil with --disable-tls or in ACME
+// mode.
+var serverCert *certFiles
+
+// A certificate loaded from a pair of files, which can be reloaded.
+type certFiles struct {
+	certFilename, keyFilename string
+
+	lock sync.Mutex
+	cert *tls.Certificate
+	// The modification times of the files when they were last loaded.
+	certModTime, keyModTime time.Time
+}
+
+// Load a certificate and key from files.
+func newCertFiles(certFilename, keyFilename string) (*certFiles, error) {
+	c := &certFiles{certFilename: certFilename, keyFilename: keyFilename}
+	err := c.reload()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Return the modification times of the files, or zero times for any that
+// can't be found.
+func (c *certFiles) modTimes() (certModTime, keyModTime time.Time) {
+	if fi, err := os.Stat(c.certFilename); err == nil {
+		certModTime = fi.ModTime()
+	}
+	if fi, err := os.Stat(c.keyFilename); err == nil {
+		keyModTime = fi.ModTime()
+	}
+	return
+}
+
+// Load the files again. On error, the old certificate is kept.
+func (c *certFiles) reload() error {
+	certModTime, keyModTime := c.modTimes()
+	cert, err := tls.LoadX509KeyPair(c.certFilename, c.keyFilename)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Even if this attempt fails, don't try again until the files change.
+	c.certModTime, c.keyModTime = certModTime, keyModTime
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	return nil
+}
+
+// Reload the files and log the outcome.
+func (c *certFiles) reloadAndLog() {
+	err := c.reload()
+	if err != nil {
+		log.Printf("error reloading certificate, keeping the old one: %s", err)
+		return
+	}
+	log.Printf("reloaded certificate from %s", c.certFilename)
+}
+
+// Have the files changed since they were last loaded?
+func (c *certFiles) changed() bool {
+	certModTime, keyModTime := c.modTimes()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return !certModTime.Equal(c.certModTime) || !keyModTime.Equal(c.keyModTime)
+}
+
+// Reload the files whenever they change. Doesn't return.
+func (c *certFiles) watch() {
+	for {
+		time.Sleep(certPollInterval)
+		if c.changed() {
+			c.reloadAndLog()
+		}
+	}
+}
+
+// The GetCertificate function of a tls.Config.
+func (c *certFiles) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cert, nil
+}
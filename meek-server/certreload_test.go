@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Make a self-signed certificate for name, and return it and its key in PEM
+// format.
+func makeCertPEM(name string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func TestCertFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meek-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFilename := filepath.Join(dir, "cert.pem")
+	keyFilename := filepath.Join(dir, "key.pem")
+
+	// Write a certificate for name, with modification time mtime.
+	write := func(name string, mtime time.Time) {
+		certPEM, keyPEM, err := makeCertPEM(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range []struct {
+			filename string
+			data     []byte
+		}{{certFilename, certPEM}, {keyFilename, keyPEM}} {
+			err = ioutil.WriteFile(f.filename, f.data, 0600)
+			if err == nil {
+				err = os.Chtimes(f.filename, mtime, mtime)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Check which certificate GetCertificate returns.
+	check := func(c *certFiles, expected string) {
+		cert, err := c.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.Subject.CommonName != expected {
+			t.Errorf("certificate for %q (expected %q)", leaf.Subject.CommonName, expected)
+		}
+	}
+
+	mtime := time.Now().Add(-time.Hour)
+	write("a.example.com", mtime)
+	c, err := newCertFiles(certFilename, keyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c, "a.example.com")
+	if c.changed() {
+		t.Errorf("changed without a change")
+	}
+
+	// A certificate that doesn't match the key fails to load, and the old
+	// one stays in use.
+	certPEM, _, err := makeCertPEM("b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFilename, certPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.changed() {
+		t.Errorf("not changed after writing the certificate")
+	}
+	err = c.reload()
+	if err == nil {
+		t.Errorf("mismatched key unexpectedly loaded")
+	}
+	check(c, "a.example.com")
+	// The failure isn't retried until the files change again.
+	if c.changed() {
+		t.Errorf("changed after a failed reload")
+	}
+
+	// A good pair replaces it.
+	write("c.example.com", mtime.Add(time.Minute))
+	if !c.changed() {
+		t.Errorf("not changed after writing a new pair")
+	}
+	err = c.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c, "c.example.com")
+
+	// Missing files are an error too.
+	os.Remove(keyFilename)
+	if c.reload() == nil {
+		t.Errorf("missing key unexpectedly loaded")
+	}
+	check(c, "c.example.com")
+
+	_, err = newCertFiles(certFilename, keyFilename)
+	if err == nil {
+		t.Errorf("newCertFiles with a missing key unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+)
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+// The code in this file has to do with the tunable parameters of the server,
+// and with the configuration file given by --config.
+//
+// The configuration file is a JSON object whose members are command line
+// options without the leading dashes, for example:
+// 	{
+// 		"cert": "/etc/meek/cert.pem",
+// 		"key": "/etc/meek/key.pem",
+// 		"port": 7443,
+// 		"turnaround-timeout": "20ms"
+// 	}
+// An option given on the command line overrides the same option in the file.
+//
+// The tunable parameters may additionally be set per transport with
+// ServerTransportOptions in torrc, which tor passes in the
+// TOR_PT_SERVER_TRANSPORT_OPTIONS environment variable:
+// 	ServerTransportOptions meek turnaround-timeout=20ms max-session-staleness=300s
+// These override both the command line and the configuration file.
+
+// The largest payload length that clients can handle; they won't read more than
+// this much of a response body.
+const maxMaxPayloadLength = 0x10000
+
+// Tunable parameters. The defaults are those of meek.DefaultServerConfig, and
+// the constant readWriteTimeout.
+type Config struct {
+	MaxPayloadLength    int
+	TurnaroundTimeout   time.Duration
+	ReadWriteTimeout    time.Duration
+	MaxSessionStaleness time.Duration
+	MaxSeqWait          time.Duration
+	// Session limits; 0 means no limit.
+	MaxSessions          int
+	MaxSessionsPerClient int
+}
+
+func defaultConfig() Config {
+	defaults := meek.DefaultServerConfig()
+	return Config{
+		MaxPayloadLength:    defaults.MaxPayloadLength,
+		TurnaroundTimeout:   defaults.TurnaroundTimeout,
+		ReadWriteTimeout:    readWriteTimeout,
+		MaxSessionStaleness: defaults.MaxSessionStaleness,
+		MaxSeqWait:          defaults.MaxSeqWait,
+
+		MaxSessions:          defaults.MaxSessions,
+		MaxSessionsPerClient: defaults.MaxSessionsPerClient,
+	}
+}
+
+// Return the parameters that concern the meek.Handler.
+func (config *Config) ServerConfig() meek.ServerConfig {
+	return meek.ServerConfig{
+		MaxPayloadLength:    config.MaxPayloadLength,
+		TurnaroundTimeout:   config.TurnaroundTimeout,
+		MaxSessionStaleness: config.MaxSessionStaleness,
+		MaxSeqWait:          config.MaxSeqWait,
+		WriteTimeout:        config.ReadWriteTimeout,
+
+		MaxSessions:          config.MaxSessions,
+		MaxSessionsPerClient: config.MaxSessionsPerClient,
+	}
+}
+
+// Register command line options for the fields of config.
+func (config *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&config.MaxPayloadLength, "max-payload-length", config.MaxPayloadLength, "largest request body to accept and response body to send")
+	fs.DurationVar(&config.TurnaroundTimeout, "turnaround-timeout", config.TurnaroundTimeout, "how long to wait for data from the OR port before responding")
+	fs.DurationVar(&config.ReadWriteTimeout, "read-write-timeout", config.ReadWriteTimeout, "HTTP server read and write timeout")
+	fs.DurationVar(&config.MaxSessionStaleness, "max-session-staleness", config.MaxSessionStaleness, "how long an idle session lasts")
+	fs.DurationVar(&config.MaxSeqWait, "max-seq-wait", config.MaxSeqWait, "how long a multipath request waits for its turn")
+	fs.IntVar(&config.MaxSessions, "max-sessions", config.MaxSessions, "most sessions open at once (0 for no limit)")
+	fs.IntVar(&config.MaxSessionsPerClient, "max-sessions-per-client", config.MaxSessionsPerClient, "most sessions open at once from one client address (0 for no limit)")
+}
+
+// Set the parameter called key (named as in the command line options) from its
+// string representation.
+func (config *Config) Set(key, value string) error {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	config.RegisterFlags(fs)
+	if fs.Lookup(key) == nil {
+		return errors.New(fmt.Sprintf("unknown option %q", key))
+	}
+	err := fs.Set(key, value)
+	if err != nil {
+		return errors.New(fmt.Sprintf("bad value %q for %s: %s", value, key, err))
+	}
+	return nil
+}
+
+// Set parameters from ServerTransportOptions.
+func (config *Config) SetArgs(args pt.Args) error {
+	var keys []string
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, _ := args.Get(key)
+		err := config.Set(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return config.Check()
+}
+
+// Return an error if any parameter is out of range.
+func (config *Config) Check() error {
+	if config.MaxPayloadLength <= 0 || config.MaxPayloadLength > maxMaxPayloadLength {
+		return errors.New(fmt.Sprintf("max-payload-length must be between 1 and %d", maxMaxPayloadLength))
+	}
+	if config.ReadWriteTimeout <= 0 {
+		return errors.New("read-write-timeout must be positive")
+	}
+	if config.TurnaroundTimeout < 0 || config.TurnaroundTimeout >= config.ReadWriteTimeout {
+		return errors.New("turnaround-timeout must be at least 0 and less than read-write-timeout")
+	}
+	if config.MaxSessionStaleness <= 0 {
+		return errors.New("max-session-staleness must be positive")
+	}
+	// A request waiting for its turn must still be able to write its
+	// response before the write timeout.
+	if config.MaxSeqWait <= 0 || config.MaxSeqWait >= config.ReadWriteTimeout {
+		return errors.New("max-seq-wait must be positive and less than read-write-timeout")
+	}
+	if config.MaxSessions < 0 {
+		return errors.New("max-sessions must not be negative")
+	}
+	if config.MaxSessionsPerClient < 0 {
+		return errors.New("max-sessions-per-client must not be negative")
+	}
+	return nil
+}
+
+// Read a configuration file and return the string representation of each of
+// its options.
+func readConfigFile(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	err = json.Unmarshal(data, &values)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", filename, err))
+	}
+
+	options := make(map[string]string)
+	for key, v := range values {
+		switch v := v.(type) {
+		case string:
+			options[key] = v
+		case bool:
+			options[key] = strconv.FormatBool(v)
+		case float64:
+			options[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return nil, errors.New(fmt.Sprintf("%s: %s must be a string, number, or boolean", filename, key))
+		}
+	}
+	return options, nil
+}
+
+// Return the names of the options that were set explicitly on the command line.
+func commandLineOptions(fs *flag.FlagSet) map[string]bool {
+	setOnCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+	return setOnCommandLine
+}
+
+// Read a configuration file and apply each of its options to fs, except those
+// that were set explicitly on the command line.
+func loadConfigFile(filename string, fs *flag.FlagSet) error {
+	options, err := readConfigFile(filename)
+	if err != nil {
+		return err
+	}
+
+	setOnCommandLine := commandLineOptions(fs)
+
+	var keys []string
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "config" || fs.Lookup(key) == nil {
+			return errors.New(fmt.Sprintf("%s: unknown option %q", filename, key))
+		}
+		if setOnCommandLine[key] {
+			continue
+		}
+		value := options[key]
+		err = fs.Set(key, value)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: bad value %q for %s: %s", filename, value, key, err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+
+func TestConfigSetArgs(t *testing.T) {
+	badTests := [...]map[string]string{
+		{"bogus": "1"},
+		{"cert": "cert.pem"},
+		{"max-payload-length": "0"},
+		{"max-payload-length": "65537"},
+		{"max-payload-length": "x"},
+		{"turnaround-timeout": "-1s"},
+		{"turnaround-timeout": "30s"},
+		{"read-write-timeout": "0"},
+		{"max-session-staleness": "0"},
+		{"max-seq-wait": "1"},
+		{"max-seq-wait": "20s"},
+		{"max-seq-wait": "30s"},
+		{"read-write-timeout": "10s"},
+		{"max-seq-wait": "5s", "read-write-timeout": "5s"},
+		{"max-sessions": "-1"},
+		{"max-sessions-per-client": "x"},
+	}
+
+	for _, test := range badTests {
+		args := pt.Args{}
+		for key, value := range test {
+			args.Add(key, value)
+		}
+		config := defaultConfig()
+		err := config.SetArgs(args)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", test)
+		}
+	}
+
+	args := pt.Args{}
+	args.Add("turnaround-timeout", "20ms")
+	args.Add("max-payload-length", "4096")
+	args.Add("max-sessions-per-client", "8")
+	args.Add("max-seq-wait", "5s")
+	args.Add("read-write-timeout", "6s")
+	config := defaultConfig()
+	err := config.SetArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := defaultConfig()
+	expected.TurnaroundTimeout = 20 * time.Millisecond
+	expected.MaxPayloadLength = 4096
+	expected.MaxSessionsPerClient = 8
+	expected.MaxSeqWait = 5 * time.Second
+	expected.ReadWriteTimeout = 6 * time.Second
+	if config != expected {
+		t.Errorf("→ %+v (expected %+v)", config, expected)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "meek-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte(`{"port": 7443, "disable-tls": true, "log": "file.log", "turnaround-timeout": "20ms"}`))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var port int
+	var disableTLS bool
+	var logFilename string
+	config := defaultConfig()
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.IntVar(&port, "port", 0, "")
+	fs.BoolVar(&disableTLS, "disable-tls", false, "")
+	fs.StringVar(&logFilename, "log", "", "")
+	config.RegisterFlags(fs)
+	err = fs.Parse([]string{"--log", "other.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = loadConfigFile(f.Name(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 7443 || !disableTLS || config.TurnaroundTimeout != 20*time.Millisecond {
+		t.Errorf("port=%d disable-tls=%v turnaround-timeout=%s", port, disableTLS, config.TurnaroundTimeout)
+	}
+	// The command line takes precedence.
+	if logFilename != "other.log" {
+		t.Errorf("log=%q", logFilename)
+	}
+
+	badTests := [...]string{
+		`[]`,
+		`{"bogus": 1}`,
+		`{"config": "other.json"}`,
+		`{"port": "x"}`,
+		`{"port": [1]}`,
+	}
+	for _, input := range badTests {
+		err := ioutil.WriteFile(f.Name(), []byte(input), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := defaultConfig()
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		fs.IntVar(&port, "port", 0, "")
+		config.RegisterFlags(fs)
+		err = loadConfigFile(f.Name(), fs)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+}
+
+func TestReloadRates(t *testing.T) {
+	f, err := ioutil.TempFile("", "meek-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	current := rateConfig{SessionRate: 20000, TotalRate: 100000}
+	tests := []struct {
+		input            string
+		setOnCommandLine map[string]bool
+		expected         rateConfig
+	}{
+		{`{"session-rate": 30000, "total-rate": 200000, "port": 7443}`, nil, rateConfig{30000, 200000}},
+		// A missing rate means no limit.
+		{`{"session-rate": 30000}`, nil, rateConfig{30000, 0}},
+		{`{}`, nil, rateConfig{0, 0}},
+		// The command line takes precedence.
+		{`{"session-rate": 30000, "total-rate": 200000}`, map[string]bool{"total-rate": true}, rateConfig{30000, 100000}},
+		{`{}`, map[string]bool{"session-rate": true}, rateConfig{20000, 0}},
+	}
+	for _, test := range tests {
+		err := ioutil.WriteFile(f.Name(), []byte(test.input), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := reloadRates(f.Name(), current, test.setOnCommandLine)
+		if err != nil {
+			t.Errorf("%q → error %s", test.input, err)
+		} else if rc != test.expected {
+			t.Errorf("%q %v → %+v (expected %+v)", test.input, test.setOnCommandLine, rc, test.expected)
+		}
+	}
+
+	badTests := [...]string{
+		`{"session-rate": "x"}`,
+		`{"session-rate": 100}`,
+		`{"total-rate": -1}`,
+		`not json`,
+	}
+	for _, input := range badTests {
+		err := ioutil.WriteFile(f.Name(), []byte(input), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = reloadRates(f.Name(), current, nil)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// The code in this file has to do with Encrypted Client Hello. A client that
+// knows our ECHConfigList can encrypt the real server name in its ClientHello,
+// showing only the public name on the outside.
+//
+// ECH keys are stored in a PEM file in the format of
+// https://datatracker.ietf.org/doc/html/draft-farrell-tls-pemesni: a PKCS#8
+// "PRIVATE KEY" block holding an X25519 key, followed by an "ECHCONFIG" block
+// holding an ECHConfigList whose configurations all use that key. The
+// --gen-ech-key option writes such a file.
+
+const (
+	// ECHConfig version for draft-ietf-tls-esni-18 and later.
+	echConfigVersion = 0xfe0d
+	// HPKE identifiers from RFC 9180.
+	hpkeKEMX25519HKDFSHA256 = 0x0020
+	hpkeKDFHKDFSHA256       = 0x0001
+	hpkeAEADAES128GCM       = 0x0001
+	hpkeAEADChaCha20Poly    = 0x0003
+)
+
+// Split an ECHConfigList into its marshaled ECHConfigs.
+func splitECHConfigList(echConfigList []byte) ([][]byte, error) {
+	if len(echConfigList) < 2 || int(binary.BigEndian.Uint16(echConfigList)) != len(echConfigList)-2 {
+		return nil, errors.New("malformed ECHConfigList")
+	}
+	var configs [][]byte
+	rest := echConfigList[2:]
+	for len(rest) > 0 {
+		// Version and length.
+		if len(rest) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n := 4 + int(binary.BigEndian.Uint16(rest[2:4]))
+		if n > len(rest) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		configs = append(configs, rest[:n])
+		rest = rest[n:]
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("empty ECHConfigList")
+	}
+	return configs, nil
+}
+
+// Read ECH keys from a PEM file as written by --gen-ech-key.
+func loadECHKeys(filename string) ([]tls.EncryptedClientHelloKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var privateKey *ecdh.PrivateKey
+	var echConfigList []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			privateKey, ok = key.(*ecdh.PrivateKey)
+			if !ok || privateKey.Curve() != ecdh.X25519() {
+				return nil, errors.New(fmt.Sprintf("%s: private key is not X25519", filename))
+			}
+		case "ECHCONFIG":
+			echConfigList = block.Bytes
+		}
+	}
+	if privateKey == nil || echConfigList == nil {
+		return nil, errors.New(fmt.Sprintf("%s: need both a PRIVATE KEY and an ECHCONFIG", filename))
+	}
+	configs, err := splitECHConfigList(echConfigList)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", filename, err))
+	}
+	keys := make([]tls.EncryptedClientHelloKey, len(configs))
+	for i, config := range configs {
+		keys[i].Config = config
+		keys[i].PrivateKey = privateKey.Bytes()
+		keys[i].SendAsRetry = true
+	}
+	return keys, nil
+}
+
+// Marshal an ECHConfig for the given X25519 public key and public name.
+func marshalECHConfig(configID byte, publicKey []byte, publicName string) ([]byte, error) {
+	if len(publicName) == 0 || len(publicName) > 255 {
+		return nil, errors.New(fmt.Sprintf("bad public name %q", publicName))
+	}
+	var contents bytes.Buffer
+	contents.WriteByte(configID)
+	binary.Write(&contents, binary.BigEndian, uint16(hpkeKEMX25519HKDFSHA256))
+	binary.Write(&contents, binary.BigEndian, uint16(len(publicKey)))
+	contents.Write(publicKey)
+	suites := []uint16{
+		hpkeKDFHKDFSHA256, hpkeAEADAES128GCM,
+		hpkeKDFHKDFSHA256, hpkeAEADChaCha20Poly,
+	}
+	binary.Write(&contents, binary.BigEndian, uint16(2*len(suites)))
+	binary.Write(&contents, binary.BigEndian, suites)
+	// maximum_name_length: 0 means no hint.
+	contents.WriteByte(0)
+	contents.WriteByte(byte(len(publicName)))
+	contents.WriteString(publicName)
+	// No extensions.
+	binary.Write(&contents, binary.BigEndian, uint16(0))
+
+	var config bytes.Buffer
+	binary.Write(&config, binary.BigEndian, uint16(echConfigVersion))
+	binary.Write(&config, binary.BigEndian, uint16(contents.Len()))
+	config.Write(contents.Bytes())
+	return config.Bytes(), nil
+}
+
+// Generate a new ECH key for publicName, and write it in PEM format to w. Also
+// returns the ECHConfigList that clients need, in base64.
+func generateECHKey(publicName string, w io.Writer) (string, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	var configID [1]byte
+	_, err = rand.Read(configID[:])
+	if err != nil {
+		return "", err
+	}
+	config, err := marshalECHConfig(configID[0], privateKey.PublicKey().Bytes(), publicName)
+	if err != nil {
+		return "", err
+	}
+	var echConfigList bytes.Buffer
+	binary.Write(&echConfigList, binary.BigEndian, uint16(len(config)))
+	echConfigList.Write(config)
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	err = pem.Encode(w, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err != nil {
+		return "", err
+	}
+	err = pem.Encode(w, &pem.Block{Type: "ECHCONFIG", Bytes: echConfigList.Bytes()})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(echConfigList.Bytes()), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Make a self-signed certificate for name.
+func makeTestCertificate(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestSplitECHConfigList(t *testing.T) {
+	badTests := [...][]byte{
+		[]byte(""),
+		[]byte("\x00"),
+		[]byte("\x00\x00"),
+		[]byte("\x00\x03\xfe\x0d\x00"),
+		[]byte("\x00\x05\xfe\x0d\x00\x02\x00"),
+		[]byte("\x00\x05\xfe\x0d\x00\x00\x00"),
+	}
+
+	for _, input := range badTests {
+		_, err := splitECHConfigList(input)
+		if err == nil {
+			t.Errorf("%x unexpectedly succeeded", input)
+		}
+	}
+
+	configs, err := splitECHConfigList([]byte("\x00\x0b\xfe\x0d\x00\x01\xaa\xfe\x0d\x00\x02\xbb\xcc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 || !bytes.Equal(configs[0], []byte("\xfe\x0d\x00\x01\xaa")) || !bytes.Equal(configs[1], []byte("\xfe\x0d\x00\x02\xbb\xcc")) {
+		t.Errorf("got %x", configs)
+	}
+}
+
+func TestECHHandshake(t *testing.T) {
+	const publicName = "public.example.com"
+	const serverName = "meek.example.com"
+
+	f, err := ioutil.TempFile("", "meek-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	echConfigListBase64, err := generateECHKey(publicName, f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	echKeys, err := loadECHKeys(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echConfigList, err := base64.StdEncoding.DecodeString(echConfigListBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, x509Cert := makeTestCertificate(t, serverName)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		EncryptedClientHelloKeys: echKeys,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(x509Cert)
+	conn, err := tls.Dial("tcp", ln.Addr().(*net.TCPAddr).String(), &tls.Config{
+		ServerName:                     serverName,
+		RootCAs:                        roots,
+		EncryptedClientHelloConfigList: echConfigList,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !conn.ConnectionState().ECHAccepted {
+		t.Errorf("ECH was not accepted")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// The code in this file has to do with finding the real address of clients
+// that come through a reflector or CDN, so that tor gets it through the
+// ExtORPort for its per-country statistics, and so that the session limits
+// apply per client rather than per reflector. Requests from the addresses given
+// by --trusted-proxy may name the client address in a forwarding header field:
+// Forwarded or X-Forwarded-For, or the one given by --client-addr-header:
+// 	./meek-server ... --trusted-proxy 192.0.2.0/24,2001:db8::/32 --client-addr-header X-Meek-Client-Addr
+// The App Engine reflector, which can't set X-Forwarded-For, sends the client
+// address in X-Meek-Client-Addr. See the meek package's forwarded.go for how
+// the header is read.
+
+// Addresses of proxies that are trusted to say who their clients are.
+var trustedProxies ipNetList
+
+// The header field in which trusted proxies give the client address, if not
+// the standard ones.
+var clientAddrHeader string
+
+// A list of IP address ranges, each in CIDR notation or a single IP address. It
+// is a flag.Value: each use of the option, and each comma-separated element of
+// it, adds a range.
+type ipNetList []*net.IPNet
+
+func (list *ipNetList) String() string {
+	var elems []string
+	for _, ipNet := range *list {
+		elems = append(elems, ipNet.String())
+	}
+	return strings.Join(elems, ",")
+}
+
+func (list *ipNetList) Set(s string) error {
+	for _, elem := range strings.Split(s, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		if strings.Contains(elem, "/") {
+			_, ipNet, err := net.ParseCIDR(elem)
+			if err != nil {
+				return err
+			}
+			*list = append(*list, ipNet)
+			continue
+		}
+		ip := net.ParseIP(elem)
+		if ip == nil {
+			return errors.New(fmt.Sprintf("bad IP address %q", elem))
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		*list = append(*list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nil
+}
+
+// Does the list contain ip?
+func (list ipNetList) contains(ip net.IP) bool {
+	for _, ipNet := range list {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
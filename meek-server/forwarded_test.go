@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIPNetListSet(t *testing.T) {
+	var list ipNetList
+	for _, s := range []string{"192.0.2.0/24, 198.51.100.7", "2001:db8::/32,,2001:db8:1::1"} {
+		err := list.Set(s)
+		if err != nil {
+			t.Fatalf("%q → error %s", s, err)
+		}
+	}
+	expected := "192.0.2.0/24,198.51.100.7/32,2001:db8::/32,2001:db8:1::1/128"
+	if list.String() != expected {
+		t.Errorf("→ %q (expected %q)", list.String(), expected)
+	}
+
+	badTests := [...]string{
+		"bogus",
+		"192.0.2.0/33",
+		"192.0.2.1:80",
+		"example.com",
+	}
+	for _, input := range badTests {
+		var list ipNetList
+		err := list.Set(input)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded: %s", input, list.String())
+		}
+	}
+}
@@ -1,6 +1,6 @@
 // meek-server is the server transport plugin for the meek pluggable transport.
 // It acts as an HTTP server, keeps track of session ids, and forwards received
-// data to a local OR port.
+// data to a local OR port. The protocol handling is in the meek package.
 //
 // Sample usage in torrc:
 // 	ServerTransportPlugin meek exec ./meek-server --port 8443 --cert cert.pem --key key.pem --log meek-server.log
@@ -8,46 +8,67 @@
 // 	ServerTransportPlugin meek exec ./meek-server --port 8080 --disable-tls --log meek-server.log
 //
 // The server runs in HTTPS mode by default, and the --cert and --key options
-// are required. Use the --disable-tls option to run with plain HTTP.
+// are required. Use the --disable-tls option to run with plain HTTP, or
+// --acme-hostnames to get certificates automatically; see acme.go.
+//
+// A client may spread the requests of one session over several paths at once.
+// In that case it numbers them in an X-Session-Seq header, and the server
+// processes them strictly in that order, holding back any that arrive early.
+//
+// With --ech-key, the server accepts Encrypted Client Hello using the keys in
+// the given file. Generate a key file, and print the ECHConfigList to give to
+// clients, with
+// 	./meek-server --ech-key ech.pem --gen-ech-key meek.example.com
+//
+// Options may also be given in a configuration file with --config, and the
+// tunable parameters (timeouts and payload length) may be set per transport
+// with ServerTransportOptions in torrc. See config.go.
+//
+// With --forward, meek-server runs standalone, without tor, listening on the
+// --listen address and forwarding each session to a TCP address or Unix socket
+// instead of the OR port; see standalone.go:
+// 	./meek-server --disable-tls --listen 127.0.0.1:8080 --forward 127.0.0.1:7
+// With --allow instead of --forward, each client chooses the destination of its
+// sessions, within the given allowlist; see tunnel.go.
+//
+// With --metrics, statistics are served in the Prometheus text format on a
+// separate loopback or Unix socket listener; see metrics.go. A summary of each
+// session is logged when it ends, and with --session-log also written as JSON;
+// see sessionlog.go.
+//
+// With --trusted-proxy, requests from a reflector or CDN may give the real
+// client address in a header field; see forwarded.go. With --proxy-protocol,
+// connections from a TCP load balancer may give it in a PROXY protocol header;
+// see proxyproto.go.
+//
+// The --session-rate and --total-rate options limit bandwidth, and may be
+// changed by editing the --config file and sending SIGHUP; see ratelimit.go.
+// The --cert and --key files are reloaded on SIGHUP and when they change; see
+// certreload.go.
 package main
 
 import (
 	"crypto/tls"
-	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"path"
-	"sync"
+	"path/filepath"
 	"syscall"
 	"time"
 )
 
 import "git.torproject.org/pluggable-transports/goptlib.git"
+import "git.torproject.org/pluggable-transports/meek.git/meek"
 
 const (
 	ptMethodName = "meek"
-	// Reject session ids shorter than this, as a weak defense against
-	// client bugs that send an empty session id or something similarly
-	// likely to collide.
-	minSessionIdLength = 32
-	// The largest request body we are willing to process, and the largest
-	// chunk of data we'll send back in a response.
-	maxPayloadLength = 0x10000
-	// How long we try to read something back from the OR port before
-	// returning the response.
-	turnaroundTimeout = 10 * time.Millisecond
 	// Passed as ReadTimeout and WriteTimeout when constructing the
 	// http.Server.
 	readWriteTimeout = 20 * time.Second
-	// Cull unused session ids (with their corresponding OR port connection)
-	// if we haven't seen any activity for this long.
-	maxSessionStaleness = 120 * time.Second
 )
 
 var ptInfo pt.ServerInfo
@@ -56,177 +77,21 @@ var ptInfo pt.ServerInfo
 // ends, -1 is written.
 var handlerChan = make(chan int)
 
-func httpBadRequest(w http.ResponseWriter) {
-	http.Error(w, "Bad request.\n", http.StatusBadRequest)
-}
-
-func httpInternalServerError(w http.ResponseWriter) {
-	http.Error(w, "Internal server error.\n", http.StatusInternalServerError)
+// An http.Handler that counts the requests in progress on handlerChan, so that
+// main can wait for them to finish.
+type countingHandler struct {
+	http.Handler
 }
 
-// Every session id maps to an existing OR port connection, which we keep open
-// between received requests. The first time we see a new session id, we create
-// a new OR port connection.
-type Session struct {
-	Or       *net.TCPConn
-	LastSeen time.Time
-}
-
-// Mark a session as having been seen just now.
-func (session *Session) Touch() {
-	session.LastSeen = time.Now()
-}
-
-// Is this session old enough to be culled?
-func (session *Session) IsExpired() bool {
-	return time.Since(session.LastSeen) > maxSessionStaleness
-}
-
-// There is one state per HTTP listener. In the usual case there is just one
-// listener, so there is just one global state. State also serves as the http
-// Handler.
-type State struct {
-	sessionMap map[string]*Session
-	lock       sync.Mutex
-}
-
-func NewState() *State {
-	state := new(State)
-	state.sessionMap = make(map[string]*Session)
-	return state
-}
-
-func (state *State) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (h countingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	handlerChan <- 1
 	defer func() {
 		handlerChan <- -1
 	}()
-
-	switch req.Method {
-	case "GET":
-		state.Get(w, req)
-	case "POST":
-		state.Post(w, req)
-	default:
-		httpBadRequest(w)
-	}
-}
-
-// Handle a GET request. This doesn't have any purpose apart from diagnostics.
-func (state *State) Get(w http.ResponseWriter, req *http.Request) {
-	if path.Clean(req.URL.Path) != "/" {
-		http.NotFound(w, req)
-		return
-	}
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("I’m just a happy little web server.\n"))
-}
-
-// Look up a session by id, or create a new one (with its OR port connection) if
-// it doesn't already exist.
-func (state *State) GetSession(sessionId string, req *http.Request) (*Session, error) {
-	state.lock.Lock()
-	defer state.lock.Unlock()
-
-	session := state.sessionMap[sessionId]
-	if session == nil {
-		// log.Printf("unknown session id %q; creating new session", sessionId)
-
-		or, err := pt.DialOr(&ptInfo, req.RemoteAddr, ptMethodName)
-		if err != nil {
-			return nil, err
-		}
-		session = &Session{Or: or}
-		state.sessionMap[sessionId] = session
-	}
-	session.Touch()
-
-	return session, nil
-}
-
-// Feed the body of req into the OR port, and write any data read from the OR
-// port back to w.
-func transact(session *Session, w http.ResponseWriter, req *http.Request) error {
-	body := http.MaxBytesReader(w, req.Body, maxPayloadLength+1)
-	_, err := io.Copy(session.Or, body)
-	if err != nil {
-		return errors.New(fmt.Sprintf("copying body to ORPort: %s", err))
-	}
-
-	buf := make([]byte, maxPayloadLength)
-	session.Or.SetReadDeadline(time.Now().Add(turnaroundTimeout))
-	n, err := session.Or.Read(buf)
-	if err != nil {
-		if e, ok := err.(net.Error); !ok || !e.Timeout() {
-			httpInternalServerError(w)
-			return errors.New(fmt.Sprintf("reading from ORPort: %s", err))
-		}
-	}
-	// log.Printf("read %d bytes from ORPort: %q", n, buf[:n])
-	// Set a Content-Type to prevent Go and the CDN from trying to guess.
-	w.Header().Set("Content-Type", "application/octet-stream")
-	n, err = w.Write(buf[:n])
-	if err != nil {
-		return errors.New(fmt.Sprintf("writing to response: %s", err))
-	}
-	// log.Printf("wrote %d bytes to response", n)
-	return nil
-}
-
-// Handle a POST request. Look up the session id and then do a transaction.
-func (state *State) Post(w http.ResponseWriter, req *http.Request) {
-	sessionId := req.Header.Get("X-Session-Id")
-	if len(sessionId) < minSessionIdLength {
-		httpBadRequest(w)
-		return
-	}
-
-	session, err := state.GetSession(sessionId, req)
-	if err != nil {
-		log.Print(err)
-		httpInternalServerError(w)
-		return
-	}
-
-	err = transact(session, w, req)
-	if err != nil {
-		log.Print(err)
-		state.CloseSession(sessionId)
-		return
-	}
-}
-
-// Remove a session from the map and closes its corresponding OR port
-// connection. Does nothing if the session id is not known.
-func (state *State) CloseSession(sessionId string) {
-	state.lock.Lock()
-	defer state.lock.Unlock()
-	// log.Printf("closing session %q", sessionId)
-	session, ok := state.sessionMap[sessionId]
-	if ok {
-		session.Or.Close()
-		delete(state.sessionMap, sessionId)
-	}
+	h.Handler.ServeHTTP(w, req)
 }
 
-// Loop forever, checking for expired sessions and removing them.
-func (state *State) ExpireSessions() {
-	for {
-		time.Sleep(maxSessionStaleness / 2)
-		state.lock.Lock()
-		for sessionId, session := range state.sessionMap {
-			if session.IsExpired() {
-				// log.Printf("deleting expired session %q", sessionId)
-				session.Or.Close()
-				delete(state.sessionMap, sessionId)
-			}
-		}
-		state.lock.Unlock()
-	}
-}
-
-func listenTLS(network string, addr *net.TCPAddr, certFilename, keyFilename string) (net.Listener, error) {
+func listenTLS(network string, addr *net.TCPAddr, echKeys []tls.EncryptedClientHelloKey) (net.Listener, error) {
 	// This is cribbed from the source of net/http.Server.ListenAndServeTLS.
 	// We have to separate the Listen and Serve parts because we need to
 	// report the listening address before entering Serve (which is an
@@ -234,15 +99,16 @@ func listenTLS(network string, addr *net.TCPAddr, certFilename, keyFilename stri
 	// https://groups.google.com/d/msg/Golang-nuts/3F1VRCCENp8/3hcayZiwYM8J
 	config := &tls.Config{}
 	config.NextProtos = []string{"http/1.1"}
+	config.EncryptedClientHelloKeys = echKeys
 
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFilename, keyFilename)
-	if err != nil {
-		return nil, err
+	if acmeCerts != nil {
+		acmeCerts.configureTLS(config)
+	} else {
+		// See certreload.go.
+		config.GetCertificate = serverCert.GetCertificate
 	}
 
-	conn, err := net.ListenTCP(network, addr)
+	conn, err := listenTCP(network, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -252,31 +118,36 @@ func listenTLS(network string, addr *net.TCPAddr, certFilename, keyFilename stri
 	return tlsListener, nil
 }
 
-func startListener(network string, addr *net.TCPAddr) (net.Listener, error) {
-	ln, err := net.ListenTCP(network, addr)
+func startListener(network string, addr *net.TCPAddr, config *Config, dialOr meek.DialFunc) (net.Listener, error) {
+	ln, err := listenTCP(network, addr)
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("listening with plain HTTP on %s", ln.Addr())
-	return startServer(ln)
+	return startServer(ln, config, dialOr)
 }
 
-func startListenerTLS(network string, addr *net.TCPAddr, certFilename, keyFilename string) (net.Listener, error) {
-	ln, err := listenTLS(network, addr, certFilename, keyFilename)
+func startListenerTLS(network string, addr *net.TCPAddr, echKeys []tls.EncryptedClientHelloKey, config *Config, dialOr meek.DialFunc) (net.Listener, error) {
+	ln, err := listenTLS(network, addr, echKeys)
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("listening with HTTPS on %s", ln.Addr())
-	return startServer(ln)
+	return startServer(ln, config, dialOr)
 }
 
-func startServer(ln net.Listener) (net.Listener, error) {
-	state := NewState()
-	go state.ExpireSessions()
+func startServer(ln net.Listener, config *Config, dialOr meek.DialFunc) (net.Listener, error) {
+	handler := meek.NewHandler(config.ServerConfig(), dialOr)
+	handler.Logf = log.Printf
+	handler.Metrics = metrics
+	handler.SessionEnded = logSessionSummary
+	handler.RateLimit = rateLimit
+	handler.TrustedProxies = trustedProxies
+	handler.ClientAddrHeader = clientAddrHeader
 	server := &http.Server{
-		Handler:      state,
-		ReadTimeout:  readWriteTimeout,
-		WriteTimeout: readWriteTimeout,
+		Handler:      countingHandler{handler},
+		ReadTimeout:  config.ReadWriteTimeout,
+		WriteTimeout: config.ReadWriteTimeout,
 	}
 	go func() {
 		defer ln.Close()
@@ -288,19 +159,119 @@ func startServer(ln net.Listener) (net.Listener, error) {
 	return ln, nil
 }
 
+// Do the managed-proxy setup with a tor parent process, and start an HTTP
+// listener for each requested bindaddr.
+func startManaged(port int, disableTLS bool, echKeys []tls.EncryptedClientHelloKey, config Config) []net.Listener {
+	var err error
+	ptInfo, err = pt.ServerSetup([]string{ptMethodName})
+	if err != nil {
+		log.Fatalf("error in ServerSetup: %s", err)
+	}
+
+	listeners := make([]net.Listener, 0)
+	for _, bindaddr := range ptInfo.Bindaddrs {
+		if port != 0 {
+			bindaddr.Addr.Port = port
+		}
+		switch bindaddr.MethodName {
+		case ptMethodName:
+			// ServerTransportOptions override the command line.
+			listenerConfig := config
+			err = listenerConfig.SetArgs(bindaddr.Options)
+			if err != nil {
+				pt.SmethodError(bindaddr.MethodName, err.Error())
+				break
+			}
+			var ln net.Listener
+			if disableTLS {
+				ln, err = startListener("tcp", bindaddr.Addr, &listenerConfig, dialPTOr)
+			} else {
+				ln, err = startListenerTLS("tcp", bindaddr.Addr, echKeys, &listenerConfig, dialPTOr)
+			}
+			if err != nil {
+				pt.SmethodError(bindaddr.MethodName, err.Error())
+				break
+			}
+			pt.Smethod(bindaddr.MethodName, ln.Addr())
+			listeners = append(listeners, ln)
+		default:
+			pt.SmethodError(bindaddr.MethodName, "no such method")
+		}
+	}
+	pt.SmethodsDone()
+	return listeners
+}
+
 func main() {
 	var disableTLS bool
 	var certFilename, keyFilename string
+	var echKeyFilename, genECHKeyPublicName string
+	var forwardAddr, listenAddr string
+	var allow allowList
+	var configFilename string
 	var logFilename string
+	var metricsAddr string
+	var sessionLogFilename string
 	var port int
+	config := defaultConfig()
+	var rates rateConfig
+	var acmeOpts acmeOptions
 
+	flag.Var(&allow, "allow", "run standalone, connecting sessions to the destinations clients ask for if they match this comma-separated list of HOST[:PORT] or CIDR[:PORT] (may be repeated)")
+	flag.StringVar(&clientAddrHeader, "client-addr-header", "", "header field in which --trusted-proxy proxies give the client address, instead of Forwarded and X-Forwarded-For")
+	flag.StringVar(&configFilename, "config", "", "configuration file")
 	flag.BoolVar(&disableTLS, "disable-tls", false, "don't use HTTPS")
 	flag.StringVar(&certFilename, "cert", "", "TLS certificate file (required without --disable-tls)")
+	flag.StringVar(&echKeyFilename, "ech-key", "", "file of Encrypted Client Hello keys")
+	flag.StringVar(&forwardAddr, "forward", "", "run standalone, forwarding sessions to this TCP address or unix:PATH")
+	flag.StringVar(&genECHKeyPublicName, "gen-ech-key", "", "generate an ECH key with this public name in the --ech-key file, print the ECHConfigList, and exit")
 	flag.StringVar(&keyFilename, "key", "", "TLS private key file (required without --disable-tls)")
+	flag.StringVar(&listenAddr, "listen", "", "address to listen on in standalone mode")
 	flag.StringVar(&logFilename, "log", "", "name of log file")
+	flag.StringVar(&metricsAddr, "metrics", "", "serve Prometheus metrics on this loopback address or unix:PATH")
 	flag.IntVar(&port, "port", 0, "port to listen on")
+	flag.Var(&proxyProtocolSources, "proxy-protocol", "comma-separated list of IP addresses or CIDR ranges of load balancers whose connections start with a PROXY protocol header (may be repeated)")
+	flag.StringVar(&sessionLogFilename, "session-log", "", "file to append a JSON summary of each session to")
+	flag.Var(&trustedProxies, "trusted-proxy", "comma-separated list of IP addresses or CIDR ranges of proxies trusted to give the client address in a header field (may be repeated)")
+	config.RegisterFlags(flag.CommandLine)
+	rates.RegisterFlags(flag.CommandLine)
+	acmeOpts.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
+	setOnCommandLine := commandLineOptions(flag.CommandLine)
+	if configFilename != "" {
+		err := loadConfigFile(configFilename, flag.CommandLine)
+		if err != nil {
+			log.Fatalf("error loading configuration: %s", err)
+		}
+	}
+	err := config.Check()
+	if err == nil {
+		err = rates.Check()
+	}
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	if genECHKeyPublicName != "" {
+		if echKeyFilename == "" {
+			log.Fatalf("The --gen-ech-key option requires --ech-key.\n")
+		}
+		f, err := os.OpenFile(echKeyFilename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("error creating ECH key file: %s", err)
+		}
+		echConfigList, err := generateECHKey(genECHKeyPublicName, f)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			log.Fatalf("error generating ECH key: %s", err)
+		}
+		fmt.Println(echConfigList)
+		return
+	}
+
 	if logFilename != "" {
 		f, err := os.OpenFile(logFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 		if err != nil {
@@ -310,47 +281,150 @@ func main() {
 		log.SetOutput(f)
 	}
 
+	if sessionLogFilename != "" {
+		f, err := os.OpenFile(sessionLogFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("error opening session log file: %s", err)
+		}
+		defer f.Close()
+		sessionLog = f
+	}
+
 	if disableTLS {
 		if certFilename != "" || keyFilename != "" {
 			log.Fatalf("The --cert and --key options are not allowed with --disable-tls.\n")
 		}
+		if echKeyFilename != "" {
+			log.Fatalf("The --ech-key option is not allowed with --disable-tls.\n")
+		}
+		if acmeOpts.Hostnames != "" {
+			log.Fatalf("The --acme-hostnames option is not allowed with --disable-tls.\n")
+		}
+	} else if acmeOpts.Hostnames != "" {
+		if certFilename != "" || keyFilename != "" {
+			log.Fatalf("The --cert and --key options are not allowed with --acme-hostnames.\n")
+		}
 	} else {
 		if certFilename == "" || keyFilename == "" {
-			log.Fatalf("The --cert and --key options are required.\n")
+			log.Fatalf("The --cert and --key options are required, unless --acme-hostnames is given.\n")
 		}
 	}
+	if acmeOpts.HTTPAddr != "" && acmeOpts.Hostnames == "" {
+		log.Fatalf("The --acme-http option requires --acme-hostnames.\n")
+	}
 
-	var err error
-	ptInfo, err = pt.ServerSetup([]string{ptMethodName})
-	if err != nil {
-		log.Fatalf("error in ServerSetup: %s", err)
+	if certFilename != "" {
+		serverCert, err = newCertFiles(certFilename, keyFilename)
+		if err != nil {
+			log.Fatalf("error loading certificate: %s", err)
+		}
+		go serverCert.watch()
+	}
+
+	var echKeys []tls.EncryptedClientHelloKey
+	if echKeyFilename != "" {
+		var err error
+		echKeys, err = loadECHKeys(echKeyFilename)
+		if err != nil {
+			log.Fatalf("error loading ECH keys: %s", err)
+		}
+	}
+
+	if clientAddrHeader != "" && len(trustedProxies) == 0 {
+		log.Fatalf("The --client-addr-header option requires --trusted-proxy.\n")
 	}
 
 	log.Printf("starting")
-	listeners := make([]net.Listener, 0)
-	for _, bindaddr := range ptInfo.Bindaddrs {
-		if port != 0 {
-			bindaddr.Addr.Port = port
+	if len(proxyProtocolSources) > 0 {
+		log.Printf("expecting PROXY protocol headers from %s", proxyProtocolSources.String())
+	}
+	if rates.SessionRate != 0 || rates.TotalRate != 0 {
+		setRates(rates)
+	}
+	var listeners []net.Listener
+	if metricsAddr != "" {
+		metrics = meek.NewServerMetrics()
+		metrics.RateLimit = rateLimit
+		ln, err := meek.ListenMetrics(metricsAddr, metrics, log.Printf)
+		if err != nil {
+			log.Fatalf("error starting metrics listener: %s", err)
 		}
-		switch bindaddr.MethodName {
-		case ptMethodName:
-			var ln net.Listener
-			if disableTLS {
-				ln, err = startListener("tcp", bindaddr.Addr)
-			} else {
-				ln, err = startListenerTLS("tcp", bindaddr.Addr, certFilename, keyFilename)
+		defer ln.Close()
+	}
+	if acmeOpts.Hostnames != "" {
+		cacheDir := acmeOpts.CacheDir
+		if cacheDir == "" {
+			stateDir, err := pt.MakeStateDir()
+			if err != nil {
+				log.Fatalf("The --acme-cache option is required when TOR_PT_STATE_LOCATION is not set: %s\n", err)
 			}
+			cacheDir = filepath.Join(stateDir, "acme")
+		}
+		acmeCerts, err = newACMECertificates(&acmeOpts, cacheDir)
+		if err != nil {
+			log.Fatalf("error in ACME configuration: %s", err)
+		}
+		log.Printf("getting certificates for %s from %s", acmeOpts.Hostnames, acmeOpts.Directory)
+		if acmeOpts.HTTPAddr != "" {
+			ln, err := acmeCerts.startHTTP(acmeOpts.HTTPAddr)
 			if err != nil {
-				pt.SmethodError(bindaddr.MethodName, err.Error())
-				break
+				log.Fatalf("error starting ACME HTTP listener: %s", err)
 			}
-			pt.Smethod(bindaddr.MethodName, ln.Addr())
-			listeners = append(listeners, ln)
-		default:
-			pt.SmethodError(bindaddr.MethodName, "no such method")
+			defer ln.Close()
 		}
 	}
-	pt.SmethodsDone()
+	if forwardAddr != "" || len(allow) > 0 {
+		var dialOr meek.DialFunc
+		if forwardAddr != "" {
+			if len(allow) > 0 {
+				log.Fatalf("The --forward and --allow options can't be used together.\n")
+			}
+			dialOr, err = makeForwardDialer(forwardAddr)
+			if err != nil {
+				log.Fatalf("bad --forward address: %s", err)
+			}
+			log.Printf("forwarding sessions to %s", forwardAddr)
+		} else {
+			dialOr = makeTunnelDialer(allow)
+			log.Printf("connecting sessions to targets allowed by %s", allow.String())
+		}
+		if port != 0 {
+			log.Fatalf("The --port option is not allowed in standalone mode; use --listen.\n")
+		}
+		if listenAddr == "" {
+			log.Fatalf("The --listen option is required in standalone mode.\n")
+		}
+		ln, err := startStandalone(listenAddr, dialOr, disableTLS, echKeys, &config)
+		if err != nil {
+			log.Fatalf("error starting standalone listener: %s", err)
+		}
+		listeners = append(listeners, ln)
+	} else {
+		listeners = startManaged(port, disableTLS, echKeys, config)
+	}
+
+	// SIGHUP reloads the certificate files, and the bandwidth limits from
+	// the configuration file.
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for sig := range hupChan {
+			log.Printf("got signal %s", sig)
+			if serverCert != nil {
+				serverCert.reloadAndLog()
+			}
+			if configFilename == "" {
+				continue
+			}
+			next, err := reloadRates(configFilename, rates, setOnCommandLine)
+			if err != nil {
+				log.Printf("error reloading configuration, keeping the old bandwidth limits: %s", err)
+				continue
+			}
+			rates = next
+			setRates(rates)
+		}
+	}()
 
 	var numHandlers int = 0
 	var sig os.Signal
@@ -0,0 +1,15 @@
+package main
+
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+// The code in this file has to do with the metrics endpoint given by
+// --metrics. It is a separate plain-HTTP listener, on a loopback address or a
+// Unix socket so that it isn't exposed to clients, that serves statistics in
+// the Prometheus text format at /metrics:
+// 	./meek-server ... --metrics 127.0.0.1:9100
+// 	./meek-server ... --metrics unix:/run/meek-server/metrics.sock
+// The statistics cover all the HTTP listeners together. The address is checked
+// and the endpoint served by meek.ListenMetrics.
+
+// Statistics for all listeners; nil unless --metrics was given.
+var metrics *meek.ServerMetrics
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The code in this file has to do with the PROXY protocol, by which a TCP load
+// balancer such as HAProxy tells the server behind it the address of the
+// client, in a header at the start of each connection:
+// 	https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+// With --proxy-protocol, connections from the given addresses must start with a
+// version 1 (text) or version 2 (binary) header, and the address in it takes
+// the place of the connection's remote address: it is what tor gets through the
+// ExtORPort, and what the session limits count by. Connections from other
+// addresses are taken as they are, so that clients can't claim to be someone
+// else:
+// 	./meek-server ... --proxy-protocol 10.0.0.5,10.0.1.0/24
+// The balancer must not terminate TLS; meek-server reads the header before the
+// TLS handshake.
+
+// How long a connection has to send its PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// The longest version 1 header, including CRLF.
+const maxProxyV1Length = 107
+
+// The start of a version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Addresses from which to expect PROXY protocol headers.
+var proxyProtocolSources ipNetList
+
+// Read a version 1 header.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= maxProxyV1Length {
+			return nil, errors.New("PROXY header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY header doesn't end in CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New(fmt.Sprintf("bad PROXY header %q", line))
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") || strings.Contains(fields[2], ":") != (fields[1] == "TCP6") {
+		return nil, errors.New(fmt.Sprintf("bad source address in PROXY header %q", line))
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("bad source port in PROXY header %q", line))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Read a version 2 header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New(fmt.Sprintf("unknown PROXY protocol version %d", header[12]>>4))
+	}
+	command := header[12] & 0xf
+	family := header[13] >> 4
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0:
+		// LOCAL: a health check from the balancer itself.
+		return nil, nil
+	case 1:
+		// PROXY.
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown PROXY command %d", command))
+	}
+	switch family {
+	case 1:
+		// AF_INET: source address, destination address, source port,
+		// destination port.
+		if len(body) < 12 {
+			return nil, errors.New("PROXY header too short for IPv4")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		// AF_INET6.
+		if len(body) < 36 {
+			return nil, errors.New("PROXY header too short for IPv6")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// AF_UNSPEC or AF_UNIX: there is no useful address.
+	return nil, nil
+}
+
+// Read a PROXY protocol header of either version, and return the client address
+// it gives, or nil if it gives none.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, errors.New("no PROXY protocol header")
+}
+
+// A connection that starts with a PROXY protocol header. The header is read on
+// the first call to Read, RemoteAddr, or one of the deadline setters, so that
+// a slow sender doesn't hold up Accept.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.remoteAddr = c.Conn.RemoteAddr()
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		addr, err := readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("PROXY protocol error from %s: %s", c.remoteAddr, err)
+			c.err = err
+			c.Conn.Close()
+			return
+		}
+		if addr != nil {
+			c.remoteAddr = addr
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remoteAddr
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.readHeader()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.readHeader()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// A listener that expects a PROXY protocol header on connections from the
+// sources addresses.
+type proxyListener struct {
+	net.Listener
+	sources ipNetList
+}
+
+func (ln *proxyListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !ln.sources.contains(addr.IP) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Listen on a TCP address, expecting PROXY protocol headers from
+// proxyProtocolSources if there are any.
+func listenTCP(network string, addr *net.TCPAddr) (net.Listener, error) {
+	ln, err := net.ListenTCP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(proxyProtocolSources) == 0 {
+		return ln, nil
+	}
+	return &proxyListener{Listener: ln, sources: proxyProtocolSources}, nil
+}
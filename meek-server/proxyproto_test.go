@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, body []byte) string {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|command, family, byte(len(body)>>8), byte(len(body)))
+		return string(append(header, body...))
+	}
+	v4Body := []byte{198, 51, 100, 7, 192, 0, 2, 1, 0x12, 0x67, 0x01, 0xbb}
+	v6Body := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0x12, 0x67, 0x01, 0xbb)
+
+	goodTests := []struct {
+		input    string
+		expected string
+	}{
+		{"PROXY TCP4 198.51.100.7 192.0.2.1 4711 443\r\nGET", "198.51.100.7:4711"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4711 443\r\nGET", "[2001:db8::1]:4711"},
+		{"PROXY UNKNOWN\r\nGET", ""},
+		{"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\nGET", ""},
+		{v2(1, 0x11, v4Body) + "GET", "198.51.100.7:4711"},
+		{v2(1, 0x21, v6Body) + "GET", "[2001:db8::1]:4711"},
+		// TLVs after the addresses are skipped.
+		{v2(1, 0x11, append(append([]byte{}, v4Body...), 0x04, 0x00, 0x01, 0xff)) + "GET", "198.51.100.7:4711"},
+		{v2(0, 0x00, nil) + "GET", ""},
+		{v2(1, 0x00, nil) + "GET", ""},
+	}
+	for _, test := range goodTests {
+		r := bufio.NewReader(strings.NewReader(test.input))
+		addr, err := readProxyHeader(r)
+		if err != nil {
+			t.Errorf("%q → error %s", test.input, err)
+			continue
+		}
+		if (addr == nil && test.expected != "") || (addr != nil && addr.String() != test.expected) {
+			t.Errorf("%q → %v (expected %q)", test.input, addr, test.expected)
+		}
+		// The data after the header is left unread.
+		rest, _ := ioutil.ReadAll(r)
+		if string(rest) != "GET" {
+			t.Errorf("%q left %q", test.input, rest)
+		}
+	}
+
+	badTests := [...]string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 198.51.100.7 192.0.2.1 4711 443\n",
+		"PROXY TCP4 198.51.100.7 192.0.2.1 4711\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.1 4711 443\r\n",
+		"PROXY TCP6 198.51.100.7 192.0.2.1 4711 443\r\n",
+		"PROXY TCP4 198.51.100.7 192.0.2.1 99999 443\r\n",
+		"PROXY UDP4 198.51.100.7 192.0.2.1 4711 443\r\n",
+		"PROXY TCP4 198.51.100.7 192.0.2.1 4711 443" + strings.Repeat(" ", 100) + "\r\n",
+		"PROXY TCP4 198.51.100.7",
+		v2(1, 0x11, v4Body[:8]),
+		v2(1, 0x21, v4Body),
+		v2(2, 0x11, v4Body),
+		string(proxyV2Signature) + "\x11\x11\x00\x00",
+		v2(1, 0x11, v4Body)[:20],
+	}
+	for _, input := range badTests {
+		_, err := readProxyHeader(bufio.NewReader(strings.NewReader(input)))
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	for _, test := range []struct {
+		sources  string
+		expected string
+	}{
+		// From a trusted source, the header gives the address.
+		{"127.0.0.0/8", "198.51.100.7:4711"},
+		// From elsewhere, it is just data.
+		{"192.0.2.0/24", ""},
+	} {
+		var sources ipNetList
+		err := sources.Set(test.sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln := &proxyListener{Listener: tcpLn, sources: sources}
+
+		header := "PROXY TCP4 198.51.100.7 192.0.2.1 4711 443\r\n"
+		go func() {
+			c, err := net.Dial("tcp", tcpLn.Addr().String())
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			c.Write([]byte(header + "hello"))
+		}()
+
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedData := "hello"
+		expectedAddr := test.expected
+		if test.expected == "" {
+			expectedData = header + "hello"
+			expectedAddr = conn.(*net.TCPConn).RemoteAddr().String()
+		}
+		if !bytes.Equal(data, []byte(expectedData)) {
+			t.Errorf("%s: read %q (expected %q)", test.sources, data, expectedData)
+		}
+		if conn.RemoteAddr().String() != expectedAddr {
+			t.Errorf("%s: RemoteAddr %s (expected %s)", test.sources, conn.RemoteAddr(), expectedAddr)
+		}
+		conn.Close()
+		ln.Close()
+	}
+}
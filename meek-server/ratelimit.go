@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+// The code in this file has to do with bandwidth limits, given in bytes per
+// second by --session-rate for each session and by --total-rate for all
+// sessions of all listeners together. Each applies to the upstream and
+// downstream directions separately:
+// 	./meek-server ... --session-rate 262144 --total-rate 4194304
+// The limits may be changed without a restart by editing the --config file and
+// sending SIGHUP. Limits given on the command line take precedence over the
+// file, as at startup, and a limit that is missing from the file goes back to
+// 0, no limit.
+
+// Bandwidth limits for all listeners.
+var rateLimit = meek.NewRateLimit(0, 0)
+
+// The --session-rate and --total-rate options.
+type rateConfig struct {
+	SessionRate int
+	TotalRate   int
+}
+
+// Register command line options for the fields of rc.
+func (rc *rateConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&rc.SessionRate, "session-rate", rc.SessionRate, "bandwidth limit per session in each direction, in bytes per second (0 for no limit)")
+	fs.IntVar(&rc.TotalRate, "total-rate", rc.TotalRate, "bandwidth limit for all sessions together in each direction, in bytes per second (0 for no limit)")
+}
+
+// Return an error if either rate is out of range.
+func (rc *rateConfig) Check() error {
+	if rc.SessionRate != 0 && rc.SessionRate < meek.MinRate {
+		return errors.New(fmt.Sprintf("session-rate must be 0 or at least %d", meek.MinRate))
+	}
+	if rc.TotalRate != 0 && rc.TotalRate < meek.MinRate {
+		return errors.New(fmt.Sprintf("total-rate must be 0 or at least %d", meek.MinRate))
+	}
+	return nil
+}
+
+func (rc *rateConfig) String() string {
+	format := func(rate int) string {
+		if rate == 0 {
+			return "none"
+		}
+		return fmt.Sprintf("%d B/s", rate)
+	}
+	return fmt.Sprintf("per session %s, total %s", format(rc.SessionRate), format(rc.TotalRate))
+}
+
+// Read the rates again from a configuration file. Those that were set on the
+// command line keep their values from current.
+func reloadRates(filename string, current rateConfig, setOnCommandLine map[string]bool) (rateConfig, error) {
+	var rc rateConfig
+	options, err := readConfigFile(filename)
+	if err != nil {
+		return rc, err
+	}
+	if setOnCommandLine["session-rate"] {
+		rc.SessionRate = current.SessionRate
+	}
+	if setOnCommandLine["total-rate"] {
+		rc.TotalRate = current.TotalRate
+	}
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	rc.RegisterFlags(fs)
+	for key, value := range options {
+		if fs.Lookup(key) == nil || setOnCommandLine[key] {
+			continue
+		}
+		err = fs.Set(key, value)
+		if err != nil {
+			return rc, errors.New(fmt.Sprintf("%s: bad value %q for %s: %s", filename, value, key, err))
+		}
+	}
+	return rc, rc.Check()
+}
+
+// Set the limits of rateLimit and log them.
+func setRates(rc rateConfig) {
+	rateLimit.Set(rc.SessionRate, rc.TotalRate)
+	log.Printf("bandwidth limits: %s", rc.String())
+}
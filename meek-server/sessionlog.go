@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+)
+
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+// The code in this file has to do with the summary of each session that is
+// logged when the session ends. The summary doesn't include the client's
+// address, and identifies the session only by a short hash of its id. With
+// --session-log, the summaries are also appended, one JSON object per line, to
+// the named file for log processing.
+
+// Where to write JSON session summaries; nil unless --session-log was given.
+var sessionLog io.Writer
+var sessionLogLock sync.Mutex
+
+// The SessionEnded callback of every meek.Handler.
+func logSessionSummary(summary *meek.SessionSummary) {
+	log.Printf("%s", summary)
+	if sessionLog == nil {
+		return
+	}
+	line, err := json.Marshal(summary)
+	if err != nil {
+		log.Printf("error encoding session summary: %s", err)
+		return
+	}
+	sessionLogLock.Lock()
+	defer sessionLogLock.Unlock()
+	_, err = sessionLog.Write(append(line, '\n'))
+	if err != nil {
+		log.Printf("error writing session log: %s", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+)
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+// The code in this file has to do with standalone mode, in which meek-server
+// runs without a tor parent process. Instead of getting its listening
+// addresses from the managed-proxy interface and sending sessions to the OR
+// port, it listens on the address given by --listen and forwards each session
+// to the address given by --forward, which is either a TCP host:port or
+// "unix:" followed by the path of a Unix socket:
+// 	./meek-server --disable-tls --listen 127.0.0.1:8080 --forward 127.0.0.1:7
+// 	./meek-server --cert cert.pem --key key.pem --listen :443 --forward unix:/run/app.sock
+// This is useful for tunneling something other than tor, and for testing
+// against a local echo service. With --allow in place of --forward, the client
+// chooses the destination of each session instead; see tunnel.go.
+
+// How long to wait when connecting to the --forward address.
+const forwardDialTimeout = 10 * time.Second
+
+// Connect to the OR port through the extended OR port, if available. The
+// client's target is ignored.
+func dialPTOr(remoteAddr, target string) (net.Conn, error) {
+	or, err := pt.DialOr(&ptInfo, remoteAddr, ptMethodName)
+	if err != nil {
+		return nil, err
+	}
+	return or, nil
+}
+
+// Parse a --forward address into a network and address for net.Dial.
+func parseForwardAddr(s string) (network, addr string, err error) {
+	if strings.HasPrefix(s, "unix:") {
+		return "unix", s[len("unix:"):], nil
+	}
+	_, _, err = net.SplitHostPort(s)
+	if err != nil {
+		return "", "", err
+	}
+	return "tcp", s, nil
+}
+
+// Return a meek.DialFunc that connects to the --forward address s. The client's
+// remote address is not passed on, and its target is ignored.
+func makeForwardDialer(s string) (meek.DialFunc, error) {
+	network, addr, err := parseForwardAddr(s)
+	if err != nil {
+		return nil, err
+	}
+	return func(remoteAddr, target string) (net.Conn, error) {
+		return net.DialTimeout(network, addr, forwardDialTimeout)
+	}, nil
+}
+
+// Start a listener on listenAddr whose sessions are connected by dialOr, which
+// is made by makeForwardDialer or makeTunnelDialer.
+func startStandalone(listenAddr string, dialOr meek.DialFunc, disableTLS bool, echKeys []tls.EncryptedClientHelloKey, config *Config) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	if disableTLS {
+		return startListener("tcp", addr, config, dialOr)
+	}
+	return startListenerTLS("tcp", addr, echKeys, config, dialOr)
+}
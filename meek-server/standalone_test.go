@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+func TestParseForwardAddr(t *testing.T) {
+	tests := []struct {
+		input   string
+		network string
+		addr    string
+	}{
+		{"127.0.0.1:7", "tcp", "127.0.0.1:7"},
+		{"[::1]:7", "tcp", "[::1]:7"},
+		{"localhost:9000", "tcp", "localhost:9000"},
+		{"unix:/run/app.sock", "unix", "/run/app.sock"},
+		{"unix:app.sock", "unix", "app.sock"},
+	}
+	for _, test := range tests {
+		network, addr, err := parseForwardAddr(test.input)
+		if err != nil {
+			t.Errorf("%q: %s", test.input, err)
+			continue
+		}
+		if network != test.network || addr != test.addr {
+			t.Errorf("%q → %q %q (expected %q %q)", test.input, network, addr, test.network, test.addr)
+		}
+	}
+
+	for _, input := range []string{"", "127.0.0.1", "/run/app.sock"} {
+		_, _, err := parseForwardAddr(input)
+		if err == nil {
+			t.Errorf("%q: unexpected success", input)
+		}
+	}
+}
+
+// Accept connections on ln and echo back whatever is received.
+func echoServer(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// Absorb the handler counts that ServeHTTP sends, as main otherwise would.
+func drainHandlerChan(done chan struct{}) {
+	for {
+		select {
+		case <-handlerChan:
+		case <-done:
+			return
+		}
+	}
+}
+
+// Send data in a meek request and return the response body.
+func post(t *testing.T, url, sessionID string, data []byte) []byte {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Session-Id", sessionID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestStandaloneForward(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	go drainHandlerChan(done)
+
+	dir, err := ioutil.TempDir("", "meek-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLn.Close()
+	go echoServer(tcpLn)
+	unixLn, err := net.Listen("unix", filepath.Join(dir, "echo.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixLn.Close()
+	go echoServer(unixLn)
+
+	for _, forwardAddr := range []string{tcpLn.Addr().String(), "unix:" + unixLn.Addr().String()} {
+		dialOr, err := makeForwardDialer(forwardAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := defaultConfig()
+		config.TurnaroundTimeout = 1 * time.Second
+		handler := meek.NewHandler(config.ServerConfig(), dialOr)
+		server := httptest.NewServer(countingHandler{handler})
+
+		sessionID := strings.Repeat("a", 32)
+		for _, data := range []string{"hello", "world"} {
+			body := post(t, server.URL, sessionID, []byte(data))
+			if string(body) != data {
+				t.Errorf("%s: sent %q, got back %q", forwardAddr, data, body)
+			}
+		}
+		server.Close()
+		handler.Close()
+	}
+}
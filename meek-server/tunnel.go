@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+// The code in this file has to do with tunnel mode, a kind of standalone mode
+// in which each client chooses where its session goes. The client sends the
+// destination in an X-Session-Target header (meek-client does so in its own
+// standalone mode, with the address requested of its SOCKS or HTTP CONNECT
+// proxy), and meek-server connects to it only if it matches one of the --allow
+// entries:
+// 	./meek-server --cert cert.pem --key key.pem --listen :443 --allow 10.1.0.0/16:22,db.internal:5432
+// Each entry is a host, optionally followed by ":" and a port. A missing port,
+// or "*", allows any port. The host is a name, an IP address, or a CIDR range;
+// IPv6 addresses and ranges need brackets when there is a port:
+// 	db.internal:5432
+// 	192.168.1.10
+// 	10.0.0.0/8:443
+// 	[2001:db8::/32]:*
+// A target name is allowed if it matches a name entry exactly (ignoring case).
+// Otherwise it is resolved, and the connection goes to the first of its
+// addresses that an IP entry allows, so that a name can't be used to reach an
+// address that isn't allowed.
+
+// One --allow entry. Exactly one of name and ipNet is set. A port of 0 means
+// any port.
+type allowEntry struct {
+	name  string
+	ipNet *net.IPNet
+	port  int
+}
+
+func (entry *allowEntry) String() string {
+	host := entry.name
+	if entry.ipNet != nil {
+		host = entry.ipNet.String()
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+	if entry.port == 0 {
+		return host
+	}
+	return host + ":" + strconv.Itoa(entry.port)
+}
+
+// Parse a port number, or "*" for any port (returned as 0).
+func parseAllowPort(s string) (int, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, errors.New(fmt.Sprintf("bad port %q", s))
+	}
+	return int(port), nil
+}
+
+// Parse one --allow entry.
+func parseAllowEntry(s string) (*allowEntry, error) {
+	var entry allowEntry
+	host := s
+	portStr := ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return nil, errors.New(fmt.Sprintf("missing \"]\" in %q", s))
+		}
+		host = s[1:end]
+		rest := s[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return nil, errors.New(fmt.Sprintf("garbage after \"]\" in %q", s))
+			}
+			portStr = rest[1:]
+		}
+	} else if strings.Count(s, ":") == 1 {
+		i := strings.Index(s, ":")
+		host, portStr = s[:i], s[i+1:]
+	}
+	if portStr != "" {
+		var err error
+		entry.port, err = parseAllowPort(portStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("in %q: %s", s, err))
+		}
+	}
+
+	if strings.Contains(host, "/") {
+		_, ipNet, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, err
+		}
+		entry.ipNet = ipNet
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		entry.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if strings.HasPrefix(s, "[") {
+		return nil, errors.New(fmt.Sprintf("%q in brackets is not an IP address", host))
+	} else {
+		name := strings.ToLower(strings.TrimSuffix(host, "."))
+		if name == "" || strings.ContainsAny(name, " \t/:[]") {
+			return nil, errors.New(fmt.Sprintf("bad host %q", host))
+		}
+		entry.name = name
+	}
+	return &entry, nil
+}
+
+// The list of --allow entries. It is a flag.Value: each use of the option, and
+// each comma-separated element of it, adds an entry.
+type allowList []*allowEntry
+
+func (list *allowList) String() string {
+	var entries []string
+	for _, entry := range *list {
+		entries = append(entries, entry.String())
+	}
+	return strings.Join(entries, ",")
+}
+
+func (list *allowList) Set(s string) error {
+	for _, elem := range strings.Split(s, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		entry, err := parseAllowEntry(elem)
+		if err != nil {
+			return err
+		}
+		*list = append(*list, entry)
+	}
+	return nil
+}
+
+// Is the given name allowed by a name entry?
+func (list allowList) allowsName(name string, port int) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, entry := range list {
+		if entry.name != "" && entry.name == name && (entry.port == 0 || entry.port == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is the given IP address allowed by an IP entry?
+func (list allowList) allowsIP(ip net.IP, port int) bool {
+	for _, entry := range list {
+		if entry.ipNet != nil && entry.ipNet.Contains(ip) && (entry.port == 0 || entry.port == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is there an IP entry that allows port? If not, there's no point in resolving
+// a name for that port.
+func (list allowList) hasIPEntryFor(port int) bool {
+	for _, entry := range list {
+		if entry.ipNet != nil && (entry.port == 0 || entry.port == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the address to connect to for target, or a *meek.RefusedError if the
+// allowlist doesn't permit it. lookupIP is used to resolve names that aren't themselves
+// allowed, but only if some IP entry allows the port.
+func (list allowList) resolve(target string, lookupIP func(host string) ([]net.IP, error)) (string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", &meek.RefusedError{Err: err}
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", &meek.RefusedError{Err: errors.New(fmt.Sprintf("bad port in target %q", target))}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if list.allowsIP(ip, int(port)) {
+			return target, nil
+		}
+		return "", &meek.RefusedError{Err: errors.New(fmt.Sprintf("target %s is not allowed", target))}
+	}
+	if list.allowsName(host, int(port)) {
+		return target, nil
+	}
+	// Refuse without a DNS lookup what no resolved address could make allowed.
+	if !list.hasIPEntryFor(int(port)) {
+		return "", &meek.RefusedError{Err: errors.New(fmt.Sprintf("target %s is not allowed", target))}
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if list.allowsIP(ip, int(port)) {
+			return net.JoinHostPort(ip.String(), portStr), nil
+		}
+	}
+	return "", &meek.RefusedError{Err: errors.New(fmt.Sprintf("target %s is not allowed", target))}
+}
+
+// Resolve a name with a timeout.
+func lookupIP(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), forwardDialTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// Return a meek.DialFunc that connects to the target of each session, if list
+// allows it. Sessions without a target are refused.
+func makeTunnelDialer(list allowList) meek.DialFunc {
+	return func(remoteAddr, target string) (net.Conn, error) {
+		if target == "" {
+			return nil, &meek.RefusedError{Err: errors.New("session has no target")}
+		}
+		addr, err := list.resolve(target, lookupIP)
+		if err != nil {
+			return nil, err
+		}
+		return net.DialTimeout("tcp", addr, forwardDialTimeout)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+import "git.torproject.org/pluggable-transports/meek.git/meek"
+
+func TestAllowListSet(t *testing.T) {
+	badTests := [...]string{
+		"10.0.0.0/33",
+		"10.0.0.1:0",
+		"10.0.0.1:65536",
+		"10.0.0.1:x",
+		"[2001:db8::1",
+		"[2001:db8::1]443",
+		"[bogus]:443",
+		":443",
+		"a b",
+	}
+	for _, input := range badTests {
+		var list allowList
+		err := list.Set(input)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+
+	goodTests := [...]struct {
+		input    string
+		expected string
+	}{
+		{"db.internal:5432", "db.internal:5432"},
+		{"DB.Internal.", "db.internal"},
+		{"192.168.1.10", "192.168.1.10/32"},
+		{"10.1.2.3/8:*", "10.0.0.0/8"},
+		{"10.0.0.0/8:443, example.com", "10.0.0.0/8:443,example.com"},
+		{"2001:db8::1", "[2001:db8::1/128]"},
+		{"[2001:db8::/32]:22", "[2001:db8::/32]:22"},
+	}
+	for _, test := range goodTests {
+		var list allowList
+		err := list.Set(test.input)
+		if err != nil {
+			t.Errorf("%q: %s", test.input, err)
+			continue
+		}
+		if list.String() != test.expected {
+			t.Errorf("%q → %q (expected %q)", test.input, list.String(), test.expected)
+		}
+	}
+}
+
+func TestAllowListResolve(t *testing.T) {
+	var list allowList
+	err := list.Set("db.internal:5432,10.1.0.0/16:22,192.168.1.10,[2001:db8::/32]:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errNoHost := errors.New("no such host")
+	fakeLookup := func(host string) ([]net.IP, error) {
+		switch host {
+		case "ssh.internal":
+			return []net.IP{net.ParseIP("172.16.0.1"), net.ParseIP("10.1.2.3")}, nil
+		case "evil.example":
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		}
+		return nil, errNoHost
+	}
+
+	goodTests := [...]struct {
+		target   string
+		expected string
+	}{
+		{"db.internal:5432", "db.internal:5432"},
+		{"DB.INTERNAL.:5432", "DB.INTERNAL.:5432"},
+		{"10.1.200.1:22", "10.1.200.1:22"},
+		{"192.168.1.10:80", "192.168.1.10:80"},
+		{"192.168.1.10:8080", "192.168.1.10:8080"},
+		{"[2001:db8::1]:443", "[2001:db8::1]:443"},
+		// A name that isn't allowed itself goes to an allowed address.
+		{"ssh.internal:22", "10.1.2.3:22"},
+	}
+	for _, test := range goodTests {
+		addr, err := list.resolve(test.target, fakeLookup)
+		if err != nil {
+			t.Errorf("%q: %s", test.target, err)
+			continue
+		}
+		if addr != test.expected {
+			t.Errorf("%q → %q (expected %q)", test.target, addr, test.expected)
+		}
+	}
+
+	badTests := [...]string{
+		"",
+		"db.internal",
+		"db.internal:5433",
+		"db.internal:0",
+		"10.1.200.1:23",
+		"10.2.0.1:22",
+		"192.168.1.11:80",
+		"[2001:db8::1]:80",
+		"ssh.internal:23",
+		"evil.example:22",
+		"unknown.example:22",
+	}
+	for _, target := range badTests {
+		addr, err := list.resolve(target, fakeLookup)
+		if err == nil {
+			t.Errorf("%q unexpectedly allowed → %q", target, addr)
+			continue
+		}
+		// A failed lookup is not a refusal.
+		if _, ok := err.(*meek.RefusedError); !ok && err != errNoHost {
+			t.Errorf("%q: error %T is not a *meek.RefusedError", target, err)
+		}
+	}
+}
+
+// Targets that no address could make allowed are refused without a lookup.
+func TestAllowListResolveNoLookup(t *testing.T) {
+	var list allowList
+	err := list.Set("db.internal:5432,10.1.0.0/16:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(host string) ([]net.IP, error) {
+		t.Errorf("unexpected lookup of %q", host)
+		return nil, errors.New("no such host")
+	}
+	for _, target := range []string{"db.internal:80", "evil.example:5432", "10.1.0.1.example:443"} {
+		addr, err := list.resolve(target, lookup)
+		if err == nil {
+			t.Errorf("%q unexpectedly allowed → %q", target, addr)
+		}
+	}
+}
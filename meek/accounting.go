@@ -0,0 +1,88 @@
+package meek
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The code in this file has to do with the summary of a server session that is
+// made when the session is removed. It is meant to be safe to log: it names the
+// session only by a short hash of its id (see sessionLabel), and says nothing
+// about the client's address or the session's destination.
+// 	session 3fa1c2d4 closed (expired): lasted 754s, 532 requests, 40213 bytes up, 1873120 bytes down
+// The same summary can be marshaled as JSON for log processing:
+// 	{"session":"3fa1c2d4","reason":"expired","end":"2026-10-18T12:00:00Z","requests":532,"bytes_up":40213,"bytes_down":1873120,"duration":754}
+
+// Reasons that a session is removed.
+const (
+	// The session went without requests for longer than
+	// MaxSessionStaleness.
+	CloseExpired = "expired"
+	// Moving data between a request and the OR port failed, including
+	// because the OR port closed the connection.
+	CloseError = "error"
+	// A multipath request came out of order, or its turn never came.
+	CloseSequenceError = "sequence error"
+	// The Handler was closed.
+	CloseShutdown = "shutdown"
+)
+
+// SessionSummary describes a session that has ended.
+type SessionSummary struct {
+	// A short hash of the session id.
+	Session string `json:"session"`
+	// Why the session was removed: one of the Close constants.
+	Reason string `json:"reason"`
+	// When it was removed, to the second.
+	End time.Time `json:"end"`
+	// How long it lasted, to the second.
+	Duration time.Duration `json:"-"`
+	// How many requests had their data moved.
+	Requests uint64 `json:"requests"`
+	// Bytes from the client to the OR port.
+	BytesUp uint64 `json:"bytes_up"`
+	// Bytes from the OR port to the client.
+	BytesDown uint64 `json:"bytes_down"`
+}
+
+func (summary *SessionSummary) String() string {
+	return fmt.Sprintf("session %s closed (%s): lasted %.0fs, %d requests, %d bytes up, %d bytes down",
+		summary.Session, summary.Reason, summary.Duration.Seconds(),
+		summary.Requests, summary.BytesUp, summary.BytesDown)
+}
+
+// MarshalJSON encodes the summary as a JSON object, with the duration in
+// seconds.
+func (summary *SessionSummary) MarshalJSON() ([]byte, error) {
+	// A type without the MarshalJSON method, to avoid recursion.
+	type plain SessionSummary
+	return json.Marshal(struct {
+		*plain
+		Duration int64 `json:"duration"`
+	}{(*plain)(summary), int64(summary.Duration / time.Second)})
+}
+
+// Count a request that moved up bytes from the client and down bytes to it.
+func (session *Session) count(up, down int64) {
+	session.countLock.Lock()
+	session.requests++
+	session.bytesUp += uint64(up)
+	session.bytesDown += uint64(down)
+	session.countLock.Unlock()
+}
+
+// Summarize a session that is being removed at time end.
+func (session *Session) summary(sessionId, reason string, end time.Time) *SessionSummary {
+	session.countLock.Lock()
+	defer session.countLock.Unlock()
+	return &SessionSummary{
+		Session:   sessionLabel(sessionId),
+		Reason:    reason,
+		End:       end.UTC().Truncate(time.Second),
+		Duration:  end.Sub(session.Created).Truncate(time.Second),
+		Requests:  session.requests,
+		BytesUp:   session.bytesUp,
+		BytesDown: session.bytesDown,
+	}
+}
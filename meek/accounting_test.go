@@ -0,0 +1,117 @@
+package meek
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionSummary(t *testing.T) {
+	summaries := make(chan *SessionSummary, 1)
+	handler := NewHandler(DefaultServerConfig(), func(remoteAddr, target string) (net.Conn, error) {
+		local, remote := newPipe(stringAddr(remoteAddr))
+		remote.Write([]byte("hello"))
+		return local, nil
+	})
+	handler.SessionEnded = func(summary *SessionSummary) {
+		summaries <- summary
+	}
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	sessionID := strings.Repeat("a", 32)
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader("abc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Session-Id", sessionID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	handler.CloseSession(sessionID, CloseError)
+
+	summary := <-summaries
+	if summary.Session != sessionLabel(sessionID) || strings.Contains(summary.Session, "aaaa") {
+		t.Errorf("session %q", summary.Session)
+	}
+	if summary.Reason != CloseError || summary.Requests != 2 || summary.BytesUp != 6 || summary.BytesDown != 5 {
+		t.Errorf("summary %+v", summary)
+	}
+	expected := fmt.Sprintf("session %s closed (error): lasted %.0fs, 2 requests, 6 bytes up, 5 bytes down", summary.Session, summary.Duration.Seconds())
+	if summary.String() != expected {
+		t.Errorf("%q (expected %q)", summary.String(), expected)
+	}
+}
+
+// SessionEnded is called without the Handler's lock held, both when a session
+// is closed and when the Handler is.
+func TestSessionEndedUnlocked(t *testing.T) {
+	handler := NewHandler(DefaultServerConfig(), func(remoteAddr, target string) (net.Conn, error) {
+		local, _ := newPipe(stringAddr(remoteAddr))
+		return local, nil
+	})
+	ended := make(chan string, 2)
+	handler.SessionEnded = func(summary *SessionSummary) {
+		// This would deadlock if the lock were held.
+		handler.lock.Lock()
+		handler.lock.Unlock()
+		ended <- summary.Reason
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, sessionID := range []string{strings.Repeat("a", 32), strings.Repeat("b", 32)} {
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader("abc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Session-Id", sessionID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	handler.CloseSession(strings.Repeat("a", 32), CloseError)
+	handler.Close()
+	for _, expected := range []string{CloseError, CloseShutdown} {
+		select {
+		case reason := <-ended:
+			if reason != expected {
+				t.Errorf("reason %q (expected %q)", reason, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for SessionEnded")
+		}
+	}
+}
+
+func TestSessionSummaryJSON(t *testing.T) {
+	summary := &SessionSummary{
+		Session:   "3fa1c2d4",
+		Reason:    CloseExpired,
+		End:       time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+		Duration:  754 * time.Second,
+		Requests:  532,
+		BytesUp:   40213,
+		BytesDown: 1873120,
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"session":"3fa1c2d4","reason":"expired","end":"2026-10-18T12:00:00Z","requests":532,"bytes_up":40213,"bytes_down":1873120,"duration":754}`
+	if string(data) != expected {
+		t.Errorf("%s (expected %s)", data, expected)
+	}
+}
@@ -0,0 +1,506 @@
+// Package meek implements the meek transport as a library, for Go programs that
+// want to embed it rather than run meek-client and meek-server.
+//
+// On the client side, configure a Dialer and call its Dial method, which
+// returns a net.Conn whose stream is carried in a sequence of HTTP requests and
+// responses. The shape follows the Go API of Pluggable Transports 2.x: the
+// transport is configured once, and then each Dial makes a new connection.
+// 	u, _ := url.Parse("https://meek-reflect.appspot.com/")
+// 	dialer := &meek.Dialer{
+// 		Paths:  []meek.Path{{URL: u, Front: "www.google.com"}},
+// 		Tuning: meek.DefaultTuning(),
+// 	}
+// 	conn, err := dialer.Dial()
+//
+// On the server side, a Handler is an http.Handler that can be mounted in an
+// existing web server, connecting each session with a DialFunc. A Listener is
+// a Handler that instead returns each session as a net.Conn from Accept:
+// 	ln := meek.NewListener(meek.DefaultServerConfig())
+// 	http.Handle("/meek/", ln)
+// 	conn, err := ln.Accept()
+package meek
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// A session ID is a randomly generated string that identifies a
+	// long-lived session. We split a TCP stream across multiple HTTP
+	// requests, and those with the same session ID belong to the same
+	// stream.
+	sessionIdLength = 32
+	// The size of the largest chunk of data we will read from the
+	// connection before forwarding it in a request, and the maximum size
+	// of a body we are willing to handle in a reply.
+	maxPayloadLength = 0x10000
+	// We must poll the server to see if it has anything to send; there is
+	// no way for the server to push data back to us until we send an HTTP
+	// request. When a timer expires, we send a request even if it has an
+	// empty body. The interval starts at this value and then grows.
+	initPollInterval = 100 * time.Millisecond
+	// Maximum polling interval.
+	maxPollInterval = 5 * time.Second
+	// Geometric increase in the polling interval each time we fail to read
+	// data.
+	pollIntervalMultiplier = 1.5
+	// Try an HTTP roundtrip at most this many times.
+	maxTries = 10
+	// Wait about this long before the first retry, and about twice as
+	// long before each retry after that, up to maxRetryDelay. See retry.go.
+	retryDelay    = 1 * time.Second
+	maxRetryDelay = 30 * time.Second
+	// Don't start a retry this long or more after the first try.
+	retryDeadline = 2 * time.Minute
+)
+
+// Tuning holds the polling and retry parameters of a Dialer.
+type Tuning struct {
+	// The first interval between polls when the connection goes idle.
+	InitPollInterval time.Duration
+	// The longest interval between polls.
+	MaxPollInterval time.Duration
+	// How much the interval grows with each idle poll.
+	PollIntervalMultiplier float64
+	// How many times to try a request that fails in a way that may be
+	// transient.
+	MaxTries int
+	// The wait before the first retry.
+	RetryDelay time.Duration
+	// The longest wait between retries.
+	MaxRetryDelay time.Duration
+	// Don't retry if the wait would end this long after the first try.
+	RetryDeadline time.Duration
+}
+
+// DefaultTuning returns the default polling and retry parameters.
+func DefaultTuning() Tuning {
+	return Tuning{
+		InitPollInterval:       initPollInterval,
+		MaxPollInterval:        maxPollInterval,
+		PollIntervalMultiplier: pollIntervalMultiplier,
+		MaxTries:               maxTries,
+		RetryDelay:             retryDelay,
+		MaxRetryDelay:          maxRetryDelay,
+		RetryDeadline:          retryDeadline,
+	}
+}
+
+// A Path is one way of reaching the server.
+type Path struct {
+	// The URL to request.
+	URL *url.URL
+	// If not empty, the domain to use in place of the URL's host for the
+	// DNS lookup, TCP connection, and TLS SNI. The URL's host still goes
+	// in the HTTP Host header.
+	Front string
+	// TLS configuration for this path. If nil, the Dialer's TLSConfig is
+	// used.
+	TLSConfig *tls.Config
+}
+
+// A Dialer makes meek connections.
+type Dialer struct {
+	// The paths to the server. If there is more than one, the requests of
+	// each connection are spread across all of them at once, and carry an
+	// X-Session-Seq header so the server can put them back in order.
+	Paths []Path
+	// URL of an upstream HTTP proxy. If nil, no proxy is used.
+	ProxyURL *url.URL
+	// TLS configuration for the connection to the front. If nil, the
+	// default configuration is used.
+	TLSConfig *tls.Config
+	// Makes the TCP connections to the front. If nil, net.Dial is used.
+	NetDial func(network, addr string) (net.Conn, error)
+	// Extra header fields to add to every request.
+	Header http.Header
+	// If not empty, names of header fields in the order in which to write
+	// them, after Host; fields not named follow in Go's usual order. It
+	// takes effect only when Transport is nil.
+	HeaderOrder []string
+	// If not empty, the destination ("host:port") that the server should
+	// connect the session to, for servers that offer a choice. It is sent
+	// in an X-Session-Target header with every request, because any of
+	// them may be the one that opens the session on the server.
+	Target string
+	// If not nil, used for every request in place of an http.Transport
+	// made from ProxyURL, TLSConfig, and NetDial.
+	Transport http.RoundTripper
+	// Polling and retry parameters. Start from DefaultTuning.
+	Tuning Tuning
+	// If not nil, receives statistics. It may be shared by several
+	// Dialers.
+	Metrics *ClientMetrics
+	// If not nil, limits bandwidth and the total number of bytes. It may
+	// be shared by several Dialers.
+	Limit *ClientLimit
+	// If not nil, called to log retries and errors.
+	Logf func(format string, v ...interface{})
+	// If not nil, called to log debugging messages.
+	Debugf func(format string, v ...interface{})
+}
+
+func (d *Dialer) logf(format string, v ...interface{}) {
+	if d.Logf != nil {
+		d.Logf(format, v...)
+	}
+}
+
+// Dial starts a new meek session and returns a connection that carries it.
+// Nothing is sent to the server until the first read poll or write. Closing
+// the connection ends the session.
+func (d *Dialer) Dial() (net.Conn, error) {
+	if len(d.Paths) == 0 {
+		return nil, errors.New("no paths")
+	}
+	for _, path := range d.Paths {
+		if path.URL == nil {
+			return nil, errors.New("path without a URL")
+		}
+	}
+	if d.Transport == nil && d.ProxyURL != nil && d.ProxyURL.Scheme != "http" {
+		return nil, errors.New(fmt.Sprintf("don't know how to use proxy %s", d.ProxyURL.String()))
+	}
+	if d.Tuning.MaxTries < 1 {
+		return nil, errors.New("MaxTries must be at least 1")
+	}
+	if d.Limit.exhausted() {
+		return nil, ErrBudgetExhausted
+	}
+
+	sessionID, err := genSessionId()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*requestInfo, len(d.Paths))
+	for i, path := range d.Paths {
+		info := &requestInfo{
+			SessionID: sessionID,
+			Label:     sessionLabel(sessionID),
+			Multipath: len(d.Paths) > 1,
+			URL:       new(url.URL),
+			TLSConfig: path.TLSConfig,
+		}
+		*info.URL = *path.URL
+		if path.Front != "" {
+			info.Host = info.URL.Host
+			info.URL.Host = path.Front
+		}
+		if info.TLSConfig == nil {
+			info.TLSConfig = d.TLSConfig
+		}
+		infos[i] = info
+	}
+
+	local, remote := newPipe(stringAddr("meek"))
+	d.Metrics.sessionStarted(infos[0].Label)
+	go func() {
+		defer remote.Close()
+		defer d.Metrics.sessionEnded(infos[0].Label)
+		err := d.copyLoop(remote, infos)
+		if err != nil {
+			d.logf("session ended: %s", err)
+		}
+	}()
+	return local, nil
+}
+
+func genSessionId() (string, error) {
+	buf := make([]byte, sessionIdLength)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// The per-request metadata for one path of a session.
+type requestInfo struct {
+	// What to put in the X-Session-ID header.
+	SessionID string
+	// What to call the session in statistics.
+	Label string
+	// What to put in the X-Session-Seq header. Only sent when Multipath
+	// is set.
+	Seq uint64
+	// Whether this request is one of several that may be in flight at
+	// once over different paths.
+	Multipath bool
+	// The URL to request.
+	URL *url.URL
+	// The Host header to put in the HTTP request (optional and may be
+	// different from the host name in URL).
+	Host string
+	// TLS configuration for the connection to the front.
+	TLSConfig *tls.Config
+}
+
+// Do an HTTP roundtrip using the payload data in buf and the request metadata
+// in info. If the roundtrip fails before a connection to the front is
+// established, the error is an *unsentError.
+func (d *Dialer) roundTrip(buf []byte, info *requestInfo) (*http.Response, error) {
+	tr := d.Transport
+	if tr == nil {
+		t := new(http.Transport)
+		if d.ProxyURL != nil {
+			t.Proxy = http.ProxyURL(d.ProxyURL)
+		}
+		t.TLSClientConfig = info.TLSConfig
+		t.Dial = d.NetDial
+		if len(d.HeaderOrder) > 0 {
+			d.setHeaderOrder(t, info)
+		}
+		tr = t
+	}
+	req, err := http.NewRequest("POST", info.URL.String(), bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	if info.Host != "" {
+		req.Host = info.Host
+	}
+	for name, values := range d.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Session-Id", info.SessionID)
+	if d.Target != "" {
+		req.Header.Set("X-Session-Target", d.Target)
+	}
+	if info.Multipath {
+		req.Header.Set("X-Session-Seq", strconv.FormatUint(info.Seq, 10))
+	}
+	if d.Transport != nil {
+		// Other transports don't report connections.
+		return tr.RoundTrip(req)
+	}
+	// The TLS handshake is finished by the time of GotConn, so a failure
+	// before then means nothing of the request was sent.
+	var gotConn int32
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			atomic.StoreInt32(&gotConn, 1)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := tr.RoundTrip(req)
+	if err != nil && atomic.LoadInt32(&gotConn) == 0 {
+		err = &unsentError{err}
+	}
+	return resp, err
+}
+
+// Do a roundtrip, trying at most limit times if there is a failure that may be
+// transient (see retry.go for which ones are). Also returns when the successful
+// try started, so that round trip times don't count the waits between tries. In
+// case all tries result in error, returns the last error seen.
+//
+// A request that fails with a network error after it may have reached the
+// server is not tried again, because the server would take a duplicate for new
+// data (or, for a numbered request, close the session). Duplicates are still
+// possible: a 5xx status is retried, though it may come from a CDN or reflector
+// after the server has read the request. A better solution would be a system
+// of acknowledgements so we know what to resend after an error.
+func (d *Dialer) roundTripRetries(buf []byte, info *requestInfo, limit int) (*http.Response, time.Time, error) {
+	deadline := time.Now().Add(d.Tuning.RetryDeadline)
+	for try := 1; ; try++ {
+		var class errorClass
+		var retryAfter time.Duration
+		var haveRetryAfter bool
+		start := time.Now()
+		resp, err := d.roundTrip(buf, info)
+		if err == nil {
+			if resp.StatusCode == http.StatusOK {
+				return resp, start, nil
+			}
+			class = classifyStatus(resp.StatusCode)
+			err = errors.New(fmt.Sprintf("status code was %d, not %d", resp.StatusCode, http.StatusOK))
+			if class.Retryable() {
+				retryAfter, haveRetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			}
+			resp.Body.Close()
+		} else {
+			class = classifyError(err)
+			if class.Retryable() && !safeToRetry(err) {
+				d.logf("%s (%s); not trying again: the request may have been sent", err, class)
+				return nil, time.Time{}, err
+			}
+		}
+		if !class.Retryable() || try >= limit {
+			return nil, time.Time{}, err
+		}
+		delay := backoffDelay(&d.Tuning, try, mathrand.Float64())
+		if haveRetryAfter && retryAfter > delay {
+			delay = retryAfter
+		}
+		if time.Now().Add(delay).After(deadline) {
+			d.logf("%s (%s); not trying again after %.1f seconds: past the retry deadline", err, class, delay.Seconds())
+			return nil, time.Time{}, err
+		}
+		d.logf("%s (%s); trying again after %.1f seconds (%d)", err, class, delay.Seconds(), limit-try)
+		d.Metrics.retried(info.Label, info.URL.Host)
+		time.Sleep(delay)
+	}
+}
+
+// Send the data in buf to the remote URL, wait for a reply, and return the
+// reply body, along with the round trip time of the try that succeeded.
+func (d *Dialer) sendRecv(buf []byte, info *requestInfo) ([]byte, time.Duration, error) {
+	resp, start, err := d.roundTripRetries(buf, info, d.Tuning.MaxTries)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPayloadLength))
+	return body, time.Since(start), err
+}
+
+// The outcome of one sendRecv, tagged with the sequence number of its request.
+type roundTripResult struct {
+	seq  uint64
+	sent int
+	body []byte
+	rtt  time.Duration
+	err  error
+}
+
+// Repeatedly read from conn, issue HTTP requests, and write the responses back
+// to conn. There may be as many requests in flight as there are paths, one per
+// path. Responses are written to conn in the order their requests were issued,
+// no matter what order they arrive in. If d.Limit's budget runs out, the loop
+// stops and returns ErrBudgetExhausted.
+func (d *Dialer) copyLoop(conn net.Conn, paths []*requestInfo) error {
+	sched := newPollScheduler(&d.Tuning, time.Now)
+	sched.debugf = d.Debugf
+
+	ch := make(chan []byte)
+
+	// Read from the Conn and send byte slices on the channel.
+	go func() {
+		var buf [maxPayloadLength]byte
+		r := bufio.NewReader(conn)
+		for {
+			n, err := r.Read(buf[:])
+			b := make([]byte, n)
+			copy(b, buf[:n])
+			// log.Printf("read from local: %q", b)
+			ch <- b
+			if err != nil {
+				if d.Debugf != nil {
+					d.Debugf("error reading from local: %s", err)
+				}
+				break
+			}
+		}
+		close(ch)
+	}()
+
+	// Buffered so that in-flight requests can finish even after we have
+	// stopped listening.
+	resultChan := make(chan roundTripResult, len(paths))
+	// Results that arrived ahead of their turn to be written.
+	pending := make(map[uint64]roundTripResult)
+	var nextSeq, nextWrite uint64
+	inFlight := 0
+
+loop:
+	for {
+		var readChan <-chan []byte
+		var pollChan <-chan time.Time
+
+		// Only start a new request if there is a free path. Start
+		// a poll only when nothing else is outstanding, unless there's
+		// a bulk transfer, in which case keep every path busy.
+		interval := sched.Interval()
+		if inFlight < len(paths) {
+			readChan = ch
+			if sched.Parallel() || inFlight == 0 {
+				pollChan = time.After(interval)
+			}
+		}
+
+		var buf []byte
+		var ok bool
+		// log.Printf("waiting up to %.2f s", interval.Seconds())
+		// start := time.Now()
+		select {
+		case buf, ok = <-readChan:
+			if !ok {
+				break loop
+			}
+			// log.Printf("read %d bytes from local after %.2f s", len(buf), time.Since(start).Seconds())
+		case <-pollChan:
+			// log.Printf("read nothing from local after %.2f s", time.Since(start).Seconds())
+			buf = nil
+		case result := <-resultChan:
+			inFlight--
+			if result.err != nil {
+				return result.err
+			}
+			pending[result.seq] = result
+			for {
+				result, ok := pending[nextWrite]
+				if !ok {
+					break
+				}
+				delete(pending, nextWrite)
+				nextWrite++
+				_, err := conn.Write(result.body)
+				if err != nil {
+					return err
+				}
+				/*
+					if len(result.body) > 0 {
+						log.Printf("got %d bytes from remote", len(result.body))
+					} else {
+						log.Printf("got nothing from remote")
+					}
+				*/
+				sched.Completed(result.sent, len(result.body), result.rtt)
+				d.Metrics.setPollInterval(paths[0].Label, sched.Interval())
+			}
+			continue
+		}
+
+		if d.Limit.exhausted() {
+			return ErrBudgetExhausted
+		}
+		d.Limit.charge(len(buf))
+		// Reserve upload bandwidth here rather than in the goroutine,
+		// so that requests are sent in order.
+		delay := d.Limit.reserveUpload(len(buf))
+
+		// Spread requests over the paths in turn.
+		info := *paths[nextSeq%uint64(len(paths))]
+		info.Seq = nextSeq
+		nextSeq++
+		inFlight++
+		go func() {
+			time.Sleep(delay)
+			body, rtt, err := d.sendRecv(buf, &info)
+			if err == nil {
+				d.Metrics.requestDone(info.Label, info.URL.Host, len(buf), len(body), rtt)
+				d.Limit.charge(len(body))
+				time.Sleep(d.Limit.reserveDownload(len(body)))
+			}
+			resultChan <- roundTripResult{info.Seq, len(buf), body, rtt, err}
+		}()
+	}
+
+	return nil
+}
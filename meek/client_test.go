@@ -0,0 +1,235 @@
+package meek
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An HTTP server that echoes each request body back in its response, and
+// records what it sees of the meek header fields.
+type echoServer struct {
+	lock     sync.Mutex
+	hosts    map[string]bool
+	sessions map[string]bool
+	seqs     []uint64
+}
+
+func (s *echoServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	s.hosts[req.Host] = true
+	s.sessions[req.Header.Get("X-Session-Id")] = true
+	if seqStr := req.Header.Get("X-Session-Seq"); seqStr != "" {
+		seq, err := strconv.ParseUint(seqStr, 10, 64)
+		if err != nil {
+			s.lock.Unlock()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.seqs = append(s.seqs, seq)
+	}
+	s.lock.Unlock()
+	w.Write(body)
+}
+
+func TestDialerDial(t *testing.T) {
+	for _, numPaths := range []int{1, 3} {
+		handler := &echoServer{hosts: make(map[string]bool), sessions: make(map[string]bool)}
+		server := httptest.NewServer(handler)
+		serverURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Front through the test server to a made-up host name.
+		u, err := url.Parse("http://meek.example/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []Path
+		for i := 0; i < numPaths; i++ {
+			paths = append(paths, Path{URL: u, Front: serverURL.Host})
+		}
+		dialer := &Dialer{Paths: paths, Tuning: DefaultTuning()}
+		dialer.Tuning.InitPollInterval = 10 * time.Millisecond
+		conn, err := dialer.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, data := range []string{"hello", "world"} {
+			_, err = io.WriteString(conn, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, len(data))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = io.ReadFull(conn, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != data {
+				t.Errorf("%d paths: sent %q, got back %q", numPaths, data, buf)
+			}
+		}
+		conn.Close()
+		server.Close()
+
+		handler.lock.Lock()
+		if len(handler.hosts) != 1 || !handler.hosts["meek.example"] {
+			t.Errorf("%d paths: Host headers %v", numPaths, handler.hosts)
+		}
+		if len(handler.sessions) != 1 {
+			t.Errorf("%d paths: session ids %v", numPaths, handler.sessions)
+		}
+		if (numPaths > 1) != (len(handler.seqs) > 0) {
+			t.Errorf("%d paths: sequence numbers %v", numPaths, handler.seqs)
+		}
+		handler.lock.Unlock()
+	}
+}
+
+func TestDialerBadConfig(t *testing.T) {
+	u, _ := url.Parse("https://meek.example/")
+	proxyURL, _ := url.Parse("socks5://127.0.0.1:1080")
+	tests := []Dialer{
+		{Tuning: DefaultTuning()},
+		{Paths: []Path{{}}, Tuning: DefaultTuning()},
+		{Paths: []Path{{URL: u}}, ProxyURL: proxyURL, Tuning: DefaultTuning()},
+		{Paths: []Path{{URL: u}}},
+	}
+	for i, dialer := range tests {
+		conn, err := dialer.Dial()
+		if err == nil {
+			conn.Close()
+			t.Errorf("%d: unexpected success", i)
+		}
+	}
+}
+
+// A request that fails after reaching the server is not tried again, even if it
+// is numbered; one that fails before connecting is.
+func TestRoundTripRetriesSent(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var lock sync.Mutex
+	requests := 0
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Read the request and reset the connection without
+			// responding.
+			http.ReadRequest(bufio.NewReader(conn))
+			lock.Lock()
+			requests++
+			lock.Unlock()
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+
+	d := &Dialer{Tuning: DefaultTuning()}
+	d.Tuning.RetryDelay = time.Millisecond
+	d.Tuning.MaxRetryDelay = time.Millisecond
+	for _, multipath := range []bool{false, true} {
+		lock.Lock()
+		requests = 0
+		lock.Unlock()
+		info := &requestInfo{
+			SessionID: "x",
+			Multipath: multipath,
+			URL:       &url.URL{Scheme: "http", Host: ln.Addr().String(), Path: "/"},
+		}
+		_, _, err := d.roundTripRetries([]byte("data"), info, 3)
+		if err == nil {
+			t.Fatalf("multipath %v: unexpectedly succeeded", multipath)
+		}
+		lock.Lock()
+		if requests != 1 {
+			t.Errorf("multipath %v: %d requests (expected 1)", multipath, requests)
+		}
+		lock.Unlock()
+	}
+
+	// Nothing is listening on a closed port, so every try fails to connect.
+	addr := ln.Addr().String()
+	ln.Close()
+	info := &requestInfo{
+		SessionID: "x",
+		URL:       &url.URL{Scheme: "http", Host: addr, Path: "/"},
+	}
+	retries := 0
+	d.Logf = func(format string, v ...interface{}) {
+		if strings.Contains(format, "trying again after") {
+			retries++
+		}
+	}
+	_, _, err = d.roundTripRetries([]byte("data"), info, 3)
+	if err == nil {
+		t.Fatal("closed port: unexpectedly succeeded")
+	}
+	if retries != 2 {
+		t.Errorf("closed port: %d retries (expected 2)", retries)
+	}
+}
+
+// The round trip time of a request that succeeds after a retry doesn't count
+// the wait before the retry.
+func TestSendRecvRTT(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		requests++
+		first := requests == 1
+		lock.Unlock()
+		if first {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service unavailable.\n", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Dialer{Tuning: DefaultTuning()}
+	info := &requestInfo{SessionID: "x", Multipath: true, URL: u}
+	start := time.Now()
+	body, rtt, err := d.sendRecv([]byte("data"), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "ok" {
+		t.Errorf("body %q (expected %q)", body, "ok")
+	}
+	if time.Since(start) < time.Second {
+		t.Fatalf("took %s; expected a wait of at least 1s before retrying", time.Since(start))
+	}
+	if rtt >= time.Second {
+		t.Errorf("rtt %s includes the wait before retrying", rtt)
+	}
+}
@@ -0,0 +1,88 @@
+package meek
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// The code in this file has to do with bandwidth limits on the client, for
+// users who pay for what goes through the front. A ClientLimit, shared by any
+// number of Dialers, sets an upload rate and a download rate in bytes per
+// second, and a budget of bytes for all sessions together. Only request and
+// response bodies count, not HTTP headers or TLS overhead.
+//
+// The upload limit delays sending a request until the bucket can pay for its
+// body. The download limit delays the handling of a response, and with it the
+// next request, which is the only way a client can slow down the server. The
+// budget is checked before each request; once it is used up, the session that
+// notices ends with ErrBudgetExhausted, and Dial refuses to start new ones. A
+// response already in flight may take the total a little past the budget.
+
+// ErrBudgetExhausted is returned when a ClientLimit's byte budget is used up.
+var ErrBudgetExhausted = errors.New("byte budget exhausted")
+
+// ClientLimit holds bandwidth limits and a byte budget for Dialers. Use
+// NewClientLimit to make one. A nil *ClientLimit limits nothing.
+type ClientLimit struct {
+	uploadRate, downloadRate int
+	up, down                 tokenBucket
+
+	lock   sync.Mutex
+	budget int64
+	used   int64
+}
+
+// NewClientLimit returns a ClientLimit with the given rates in bytes per second,
+// and the given budget in bytes. A rate or budget of 0 means no limit.
+func NewClientLimit(uploadRate, downloadRate int, budget int64) *ClientLimit {
+	return &ClientLimit{
+		uploadRate:   uploadRate,
+		downloadRate: downloadRate,
+		budget:       budget,
+	}
+}
+
+// Budget returns the byte budget, and how much of it has been used.
+func (l *ClientLimit) Budget() (budget, used int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.budget, l.used
+}
+
+// Is the budget used up?
+func (l *ClientLimit) exhausted() bool {
+	if l == nil {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.budget > 0 && l.used >= l.budget
+}
+
+// Count n bytes of a request or response body against the budget.
+func (l *ClientLimit) charge(n int) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	l.used += int64(n)
+	l.lock.Unlock()
+}
+
+// Reserve n bytes of upload, and return how long to wait before sending them.
+func (l *ClientLimit) reserveUpload(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	return l.up.reserve(l.uploadRate, n, time.Now())
+}
+
+// Reserve n bytes of download, and return how long to wait before asking for
+// more.
+func (l *ClientLimit) reserveDownload(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	return l.down.reserve(l.downloadRate, n, time.Now())
+}
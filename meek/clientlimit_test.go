@@ -0,0 +1,71 @@
+package meek
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDialerBudget(t *testing.T) {
+	handler := &echoServer{hosts: make(map[string]bool), sessions: make(map[string]bool)}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limit := NewClientLimit(0, 0, 10)
+	dialer := &Dialer{Paths: []Path{{URL: u}}, Tuning: DefaultTuning(), Limit: limit}
+	dialer.Tuning.InitPollInterval = 10 * time.Millisecond
+	conn, err := dialer.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The request and its echo use up the budget, after which the session
+	// is closed.
+	_, err = io.WriteString(conn, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("got %q", data)
+	}
+	budget, used := limit.Budget()
+	if budget != 10 || used != 10 {
+		t.Errorf("budget %d, used %d", budget, used)
+	}
+
+	_, err = dialer.Dial()
+	if err != ErrBudgetExhausted {
+		t.Errorf("Dial after budget → %v", err)
+	}
+}
+
+func TestClientLimitUpload(t *testing.T) {
+	var l *ClientLimit
+	if d := l.reserveUpload(1000000); d != 0 {
+		t.Errorf("nil ClientLimit → %s", d)
+	}
+
+	l = NewClientLimit(8192, 0, 0)
+	if d := l.reserveUpload(8192); d != 0 {
+		t.Errorf("burst → %s", d)
+	}
+	if d := l.reserveUpload(8192); d < 900*time.Millisecond || d > time.Second {
+		t.Errorf("over rate → %s (expected about %s)", d, time.Second)
+	}
+	if d := l.reserveDownload(1000000); d != 0 {
+		t.Errorf("download without a limit → %s", d)
+	}
+}
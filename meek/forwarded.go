@@ -0,0 +1,113 @@
+package meek
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The code in this file has to do with finding the real address of a client
+// whose requests come through a reflector or CDN, whose own address is all that
+// the request's RemoteAddr shows. If the request comes from one of the
+// Handler's TrustedProxies, the client address is taken from a forwarding
+// header field instead: ClientAddrHeader if it is set, or otherwise Forwarded
+// (RFC 7239) if present, or X-Forwarded-For:
+// 	X-Forwarded-For: 198.51.100.7, 192.0.2.44
+// 	Forwarded: for=198.51.100.7, for="[2001:db8::1]:4711"
+// Each proxy appends the address it got the request from, so the list is read
+// from the right, skipping addresses of trusted proxies, and the first
+// untrusted address is the client's. A value that can't be parsed stops the
+// search at the last good address, because anything to its left is unreliable.
+// Requests from other addresses can't claim to be from someone else; their
+// forwarding headers are ignored.
+//
+// The client address is what the DialFunc gets as remoteAddr (and so what the
+// ExtORPort reports to tor), and what the session limits count by.
+
+// Does one of nets contain ip?
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse one address from a forwarding header: an IP address, optionally with a
+// port, in brackets if IPv6 with a port, or in quotes. Return it as host:port,
+// with a port of 0 if there was none, along with the IP address.
+func parseForwardedAddr(s string) (string, net.IP) {
+	s = strings.Trim(strings.TrimSpace(s), "\"")
+	host, port := s, "0"
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, port = h, p
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		host = s[1 : len(s)-1]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", nil
+	}
+	return net.JoinHostPort(ip.String(), port), ip
+}
+
+// Return the comma-separated elements of all the values of the header field
+// key, in order.
+func headerList(header http.Header, key string) []string {
+	var list []string
+	for _, value := range header[http.CanonicalHeaderKey(key)] {
+		list = append(list, strings.Split(value, ",")...)
+	}
+	return list
+}
+
+// Return the "for" parameters of a Forwarded header field, in order. An
+// element without one counts as unparseable.
+func forwardedFor(header http.Header) []string {
+	var list []string
+	for _, element := range headerList(header, "Forwarded") {
+		value := ""
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				value = kv[1]
+			}
+		}
+		list = append(list, value)
+	}
+	return list
+}
+
+// Return the address of the client that made req, as host:port.
+func (handler *Handler) clientAddr(req *http.Request) string {
+	addr := req.RemoteAddr
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(handler.TrustedProxies, ip) {
+		return addr
+	}
+
+	var list []string
+	if handler.ClientAddrHeader != "" {
+		list = headerList(req.Header, handler.ClientAddrHeader)
+	} else if _, ok := req.Header["Forwarded"]; ok {
+		list = forwardedFor(req.Header)
+	} else {
+		list = headerList(req.Header, "X-Forwarded-For")
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		a, ip := parseForwardedAddr(list[i])
+		if ip == nil {
+			break
+		}
+		addr = a
+		if !containsIP(handler.TrustedProxies, ip) {
+			break
+		}
+	}
+	return addr
+}
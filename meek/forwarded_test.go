@@ -0,0 +1,78 @@
+package meek
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseForwardedAddr(t *testing.T) {
+	tests := []struct {
+		input, expected string
+	}{
+		{"198.51.100.7", "198.51.100.7:0"},
+		{" 198.51.100.7:4711 ", "198.51.100.7:4711"},
+		{"2001:db8::1", "[2001:db8::1]:0"},
+		{"[2001:db8::1]", "[2001:db8::1]:0"},
+		{`"[2001:db8::1]:4711"`, "[2001:db8::1]:4711"},
+		{"unknown", ""},
+		{"_hidden", ""},
+		{"", ""},
+		{"example.com:80", ""},
+	}
+	for _, test := range tests {
+		addr, _ := parseForwardedAddr(test.input)
+		if addr != test.expected {
+			t.Errorf("%q → %q (expected %q)", test.input, addr, test.expected)
+		}
+	}
+}
+
+func TestHandlerClientAddr(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("192.0.2.0/24")
+	handler := &Handler{TrustedProxies: []*net.IPNet{proxies}}
+	tests := []struct {
+		remoteAddr string
+		header     map[string]string
+		expected   string
+	}{
+		// Not from a trusted proxy.
+		{"203.0.113.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "203.0.113.1:1234"},
+		// No header.
+		{"192.0.2.1:1234", nil, "192.0.2.1:1234"},
+		{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7:0"},
+		// The rightmost untrusted address wins.
+		{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "10.9.9.9, 198.51.100.7, 192.0.2.50"}, "198.51.100.7:0"},
+		// Garbage stops the search.
+		{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7, bogus, 192.0.2.50"}, "192.0.2.50:0"},
+		{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "bogus"}, "192.0.2.1:1234"},
+		// Forwarded takes precedence over X-Forwarded-For.
+		{"192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7", "Forwarded": `for="[2001:db8::1]:4711";proto=https`}, "[2001:db8::1]:4711"},
+		{"192.0.2.1:1234", map[string]string{"Forwarded": "by=192.0.2.1"}, "192.0.2.1:1234"},
+		{"192.0.2.1:1234", map[string]string{"Forwarded": "for=unknown"}, "192.0.2.1:1234"},
+		{"[2001:db8::2]:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "[2001:db8::2]:1234"},
+		{"@", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "@"},
+	}
+	for _, test := range tests {
+		req := &http.Request{RemoteAddr: test.remoteAddr, Header: make(http.Header)}
+		for key, value := range test.header {
+			req.Header.Set(key, value)
+		}
+		addr := handler.clientAddr(req)
+		if addr != test.expected {
+			t.Errorf("%q %q → %q (expected %q)", test.remoteAddr, test.header, addr, test.expected)
+		}
+	}
+
+	// With a custom header, the standard ones are ignored.
+	handler.ClientAddrHeader = "X-Meek-Client-Addr"
+	req := &http.Request{RemoteAddr: "192.0.2.1:1234", Header: make(http.Header)}
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if addr := handler.clientAddr(req); addr != "192.0.2.1:1234" {
+		t.Errorf("custom header missing → %q", addr)
+	}
+	req.Header.Set("X-Meek-Client-Addr", "198.51.100.8")
+	if addr := handler.clientAddr(req); addr != "198.51.100.8:0" {
+		t.Errorf("custom header → %q", addr)
+	}
+}
@@ -0,0 +1,214 @@
+package meek
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The code in this file has to do with writing request header fields in a
+// chosen order (Dialer.HeaderOrder), so that requests look more like those of
+// a browser. Go's net/http writes Host and User-Agent first and the rest
+// sorted by name. So the connections that the http.Transport writes requests
+// to are wrapped in an orderedConn, which rearranges the header block of each
+// request on its way out. For https URLs, that has to happen above TLS, so the
+// TLS handshake, and the CONNECT request to the proxy if there is one, are
+// done here rather than by the http.Transport.
+
+// A net.Conn that rearranges the header fields of the HTTP requests written to
+// it: Host first, then the fields named in order, in that order, then any
+// others as they were.
+type orderedConn struct {
+	net.Conn
+	order []string
+	// The start of a header block not yet written.
+	head []byte
+	// How many bytes of a request body remain to be passed through before
+	// the next header block; -1 means pass everything through.
+	body int64
+}
+
+// Rearrange the header fields of a header block (ending in a blank line) and
+// return it, along with the Content-Length of the request body that follows,
+// or -1 if it is not known.
+func reorderHeader(head []byte, order []string) ([]byte, int64) {
+	lines := strings.Split(strings.TrimSuffix(string(head), "\r\n\r\n"), "\r\n")
+	fields := lines[1:]
+	rank := func(line string) int {
+		name := line
+		if i := strings.Index(line, ":"); i >= 0 {
+			name = line[:i]
+		}
+		if strings.EqualFold(name, "Host") {
+			return -1
+		}
+		for i, n := range order {
+			if strings.EqualFold(name, n) {
+				return i
+			}
+		}
+		return len(order)
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return rank(fields[i]) < rank(fields[j])
+	})
+
+	var length int64 = -1
+	for _, line := range fields {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		name, value := line[:i], strings.TrimSpace(line[i+1:])
+		if strings.EqualFold(name, "Transfer-Encoding") {
+			return []byte(strings.Join(lines, "\r\n") + "\r\n\r\n"), -1
+		}
+		if strings.EqualFold(name, "Content-Length") {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && n >= 0 {
+				length = n
+			}
+		}
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n\r\n"), length
+}
+
+func (c *orderedConn) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if c.body < 0 {
+			_, err := c.Conn.Write(p)
+			if err != nil {
+				return 0, err
+			}
+			break
+		}
+		if c.body > 0 {
+			m := int64(len(p))
+			if m > c.body {
+				m = c.body
+			}
+			_, err := c.Conn.Write(p[:m])
+			if err != nil {
+				return 0, err
+			}
+			c.body -= m
+			p = p[m:]
+			continue
+		}
+		c.head = append(c.head, p...)
+		p = nil
+		end := bytes.Index(c.head, []byte("\r\n\r\n"))
+		if end < 0 {
+			break
+		}
+		var head []byte
+		head, c.body = reorderHeader(c.head[:end+4], c.order)
+		p = c.head[end+4:]
+		c.head = nil
+		_, err := c.Conn.Write(head)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Connect to addr through the HTTP proxy at proxyURL with a CONNECT request,
+// using dial to reach the proxy.
+func dialConnect(dial func(network, addr string) (net.Conn, error), proxyURL *url.URL, network, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := dial(network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Nothing comes after the response until we start TLS, so the
+	// bufio.Reader can't read too far.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("proxy CONNECT returned status %d", resp.StatusCode))
+	}
+	return conn, nil
+}
+
+// Set up t to write requests with the header fields in d.HeaderOrder, for a
+// request described by info.
+func (d *Dialer) setHeaderOrder(t *http.Transport, info *requestInfo) {
+	dial := d.NetDial
+	if dial == nil {
+		dial = net.Dial
+	}
+	if info.URL.Scheme != "https" {
+		// Through a proxy, the request goes in the clear to the proxy,
+		// so t can handle the proxy itself.
+		t.Dial = func(network, addr string) (net.Conn, error) {
+			conn, err := dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &orderedConn{Conn: conn, order: d.HeaderOrder}, nil
+		}
+		return
+	}
+	t.Proxy = nil
+	t.DialTLS = func(network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if d.ProxyURL != nil {
+			conn, err = dialConnect(dial, d.ProxyURL, network, addr)
+		} else {
+			conn, err = dial(network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		config := new(tls.Config)
+		if info.TLSConfig != nil {
+			config = info.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &orderedConn{Conn: tlsConn, order: d.HeaderOrder}, nil
+	}
+}
@@ -0,0 +1,196 @@
+package meek
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReorderHeader(t *testing.T) {
+	tests := []struct {
+		head     string
+		order    []string
+		expected string
+		length   int64
+	}{
+		{
+			"POST / HTTP/1.1\r\nHost: a\r\nUser-Agent: b\r\nContent-Length: 3\r\nAccept: c\r\n\r\n",
+			[]string{"accept", "User-Agent"},
+			"POST / HTTP/1.1\r\nHost: a\r\nAccept: c\r\nUser-Agent: b\r\nContent-Length: 3\r\n\r\n",
+			3,
+		},
+		{
+			// Host goes first even if not named.
+			"POST / HTTP/1.1\r\nUser-Agent: b\r\nHost: a\r\n\r\n",
+			[]string{"User-Agent"},
+			"POST / HTTP/1.1\r\nHost: a\r\nUser-Agent: b\r\n\r\n",
+			-1,
+		},
+		{
+			// Fields not named keep their order.
+			"POST / HTTP/1.1\r\nHost: a\r\nB: 1\r\nA: 2\r\nC: 3\r\n\r\n",
+			[]string{"C"},
+			"POST / HTTP/1.1\r\nHost: a\r\nC: 3\r\nB: 1\r\nA: 2\r\n\r\n",
+			-1,
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\nTransfer-Encoding: chunked\r\n\r\n",
+			nil,
+			"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\nTransfer-Encoding: chunked\r\n\r\n",
+			-1,
+		},
+	}
+	for _, test := range tests {
+		head, length := reorderHeader([]byte(test.head), test.order)
+		if string(head) != test.expected || length != test.length {
+			t.Errorf("%q %q → %q %d (expected %q %d)", test.head, test.order, head, length, test.expected, test.length)
+		}
+	}
+}
+
+// A net.Conn that records what is written to it.
+type recordConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+// Requests written in pieces, one after another, are each reordered, and their
+// bodies are left alone.
+func TestOrderedConn(t *testing.T) {
+	req := "POST / HTTP/1.1\r\nHost: a\r\nB: 1\r\nContent-Length: 10\r\nA: 2\r\n\r\nA: 3\r\n\r\nxx"
+	expected := "POST / HTTP/1.1\r\nHost: a\r\nA: 2\r\nB: 1\r\nContent-Length: 10\r\n\r\nA: 3\r\n\r\nxx"
+	for _, size := range []int{1, 5, 100} {
+		rec := new(recordConn)
+		conn := &orderedConn{Conn: rec, order: []string{"A", "B"}}
+		data := req + req
+		for len(data) > 0 {
+			n := size
+			if n > len(data) {
+				n = len(data)
+			}
+			m, err := conn.Write([]byte(data[:n]))
+			if err != nil || m != n {
+				t.Fatalf("size %d: wrote %d of %d: %v", size, m, n, err)
+			}
+			data = data[n:]
+		}
+		if rec.buf.String() != expected+expected {
+			t.Errorf("size %d: %q (expected %q)", size, rec.buf.String(), expected+expected)
+		}
+	}
+}
+
+// Accept connections on ln and return the names of the header fields of each
+// request, in the order they were written. If proxy is true, first answer a
+// CONNECT request. If config is not nil, the requests come over TLS.
+func recordHeaderOrder(ln net.Listener, proxy bool, config *tls.Config, c chan<- []string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			if proxy {
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != "CONNECT" {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			}
+			if config != nil {
+				conn = tls.Server(conn, config)
+			}
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				var names []string
+				for {
+					line, err = r.ReadString('\n')
+					if err != nil || line == "\r\n" {
+						break
+					}
+					names = append(names, line[:strings.Index(line, ":")])
+				}
+				// The test requests have a 4-byte body.
+				r.Discard(4)
+				c <- names
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+			}
+		}(conn)
+	}
+}
+
+func TestHeaderOrder(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	clientConfig := ts.Client().Transport.(*http.Transport).TLSClientConfig
+
+	order := []string{"X-Session-Id", "Accept", "User-Agent", "Content-Length"}
+	expected := []string{"Host", "X-Session-Id", "Accept", "User-Agent", "Content-Length", "Accept-Encoding"}
+	for _, test := range []struct {
+		scheme string
+		proxy  bool
+	}{
+		{"http", false},
+		{"http", true},
+		{"https", false},
+		{"https", true},
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var config *tls.Config
+		if test.scheme == "https" {
+			config = ts.TLS
+		}
+		c := make(chan []string, 1)
+		// A plain http request through a proxy is just sent to the
+		// proxy.
+		go recordHeaderOrder(ln, test.proxy && test.scheme == "https", config, c)
+
+		d := &Dialer{
+			Header:      http.Header{"Accept": []string{"*/*"}},
+			HeaderOrder: order,
+		}
+		host := ln.Addr().String()
+		if test.proxy {
+			d.ProxyURL = &url.URL{Scheme: "http", Host: ln.Addr().String()}
+			host = "127.0.0.1:1"
+			if test.scheme == "https" {
+				// The listener is the proxy and the server both.
+				host = ln.Addr().String()
+			}
+		}
+		info := &requestInfo{
+			SessionID: "x",
+			URL:       &url.URL{Scheme: test.scheme, Host: host, Path: "/"},
+			TLSConfig: clientConfig,
+		}
+		resp, err := d.roundTrip([]byte("data"), info)
+		if err != nil {
+			t.Fatalf("%s proxy %v: %v", test.scheme, test.proxy, err)
+		}
+		resp.Body.Close()
+		names := <-c
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("%s proxy %v: %q (expected %q)", test.scheme, test.proxy, names, expected)
+		}
+		ln.Close()
+	}
+}
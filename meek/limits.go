@@ -0,0 +1,101 @@
+package meek
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The code in this file has to do with admission control: limits on how many
+// sessions may be open at once, in total (ServerConfig.MaxSessions) and from
+// one client (ServerConfig.MaxSessionsPerClient). A request that would open a
+// session over a limit gets a 503 response with a Retry-After header field,
+// which meek clients honor when retrying. Clients are told apart by IP address,
+// except that all the IPv6 addresses in a /64 count as one client, since a
+// single host commonly has a whole /64 to choose from.
+
+// The Retry-After value sent with responses to requests over a session limit.
+const overLimitRetryAfter = 10 * time.Second
+
+// The error returned by GetSession for a request that would open a session over
+// one of the limits, or that a Listener has no room for.
+type limitError struct {
+	perClient bool
+	// Set when a Listener's backlog of sessions not yet accepted is full.
+	backlog bool
+}
+
+func (err *limitError) Error() string {
+	if err.backlog {
+		return "too many sessions waiting to be accepted"
+	}
+	if err.perClient {
+		return "too many sessions from one client"
+	}
+	return "too many sessions"
+}
+
+func httpServiceUnavailable(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	http.Error(w, "Service unavailable.\n", http.StatusServiceUnavailable)
+}
+
+// Return the key under which sessions from the client at addr (a host:port or
+// bare host) are counted.
+func clientKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.To4() == nil {
+		ip = ip.Mask(net.CIDRMask(64, 128))
+		return ip.String() + "/64"
+	}
+	return ip.String()
+}
+
+// Check whether a new session from client is within the limits, and if not,
+// count the rejection and return a *limitError. Sessions still being dialed
+// count toward the limits. Must be called with the lock held.
+func (handler *Handler) admit(client string) error {
+	limit := handler.config.MaxSessions
+	if limit > 0 && len(handler.sessionMap)+len(handler.pending) >= limit {
+		handler.rejectedTotal++
+		handler.Metrics.sessionRejected(false)
+		return &limitError{perClient: false}
+	}
+	limit = handler.config.MaxSessionsPerClient
+	if limit > 0 && handler.clientSessions[client] >= limit {
+		handler.rejectedPerClient++
+		handler.Metrics.sessionRejected(true)
+		return &limitError{perClient: true}
+	}
+	return nil
+}
+
+// Stop counting a session from client. Must be called with the lock held.
+func (handler *Handler) releaseClient(client string) {
+	handler.clientSessions[client]--
+	if handler.clientSessions[client] <= 0 {
+		delete(handler.clientSessions, client)
+	}
+}
+
+// Log how many sessions were rejected since the last call, if any, along with
+// how many are open. Must be called with the lock held.
+func (handler *Handler) logRejections() {
+	if handler.rejectedTotal == 0 && handler.rejectedPerClient == 0 {
+		return
+	}
+	handler.logf("rejected %d new sessions over the limit of %d and %d over the limit of %d per client; %d sessions open from %d clients",
+		handler.rejectedTotal, handler.config.MaxSessions,
+		handler.rejectedPerClient, handler.config.MaxSessionsPerClient,
+		len(handler.sessionMap), len(handler.clientSessions))
+	handler.rejectedTotal = 0
+	handler.rejectedPerClient = 0
+}
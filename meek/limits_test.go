@@ -0,0 +1,91 @@
+package meek
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientKey(t *testing.T) {
+	tests := []struct {
+		addr, expected string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"[2001:db8:1:2:3:4:5:6]:1234", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::99", "2001:db8:1:2::/64"},
+		{"[::ffff:192.0.2.1]:1234", "192.0.2.1"},
+		{"@", "@"},
+	}
+	for _, test := range tests {
+		key := clientKey(test.addr)
+		if key != test.expected {
+			t.Errorf("%q → %q (expected %q)", test.addr, key, test.expected)
+		}
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	config := DefaultServerConfig()
+	config.MaxSessions = 3
+	config.MaxSessionsPerClient = 2
+	handler := NewHandler(config, func(remoteAddr, target string) (net.Conn, error) {
+		local, _ := newPipe(stringAddr(remoteAddr))
+		return local, nil
+	})
+	defer handler.Close()
+
+	post := func(sessionID, remoteAddr string) *http.Response {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(""))
+		req.Header.Set("X-Session-Id", strings.Repeat(sessionID, 32))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	tests := []struct {
+		sessionID, remoteAddr string
+		expected              int
+	}{
+		{"a", "192.0.2.1:1", http.StatusOK},
+		{"b", "192.0.2.1:2", http.StatusOK},
+		// Over the per-client limit.
+		{"c", "192.0.2.1:3", http.StatusServiceUnavailable},
+		// Existing sessions are not affected.
+		{"a", "192.0.2.1:4", http.StatusOK},
+		{"d", "192.0.2.2:1", http.StatusOK},
+		// Over the total limit.
+		{"e", "192.0.2.3:1", http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		resp := post(test.sessionID, test.remoteAddr)
+		if resp.StatusCode != test.expected {
+			t.Errorf("%s from %s: status %d (expected %d)", test.sessionID, test.remoteAddr, resp.StatusCode, test.expected)
+		}
+		if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "10" {
+			t.Errorf("%s from %s: Retry-After %q", test.sessionID, test.remoteAddr, resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// Closing a session makes room for another from the same client.
+	handler.CloseSession(strings.Repeat("a", 32), CloseError)
+	resp := post("c", "192.0.2.1:5")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("after close: status %d", resp.StatusCode)
+	}
+
+	var lines []string
+	handler.Logf = func(format string, v ...interface{}) {
+		lines = append(lines, format)
+	}
+	handler.lock.Lock()
+	handler.logRejections()
+	handler.logRejections()
+	handler.lock.Unlock()
+	if len(lines) != 1 {
+		t.Errorf("logged %d lines (expected 1)", len(lines))
+	}
+}
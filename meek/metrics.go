@@ -0,0 +1,547 @@
+package meek
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The code in this file has to do with statistics, which are written in the
+// Prometheus text exposition format so that they can be scraped by Prometheus
+// or read by a person:
+// 	# HELP meek_server_sessions_active Sessions currently open.
+// 	# TYPE meek_server_sessions_active gauge
+// 	meek_server_sessions_active 3
+// Attach a ServerMetrics to a Handler, or a ClientMetrics to a Dialer, to
+// collect them, and serve them with its ServeHTTP, or on a separate metrics
+// endpoint with ListenMetrics.
+
+// Histogram bucket upper bounds for durations, in seconds.
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram bucket upper bounds for payload lengths, in bytes.
+var payloadBuckets = []float64{0, 64, 256, 1024, 4096, 16384, 65536}
+
+// How many of the most recent roundtrip times to compute percentiles from.
+const rttWindowLength = 100
+
+// The percentiles of roundtrip time to report.
+var rttQuantiles = []float64{0.5, 0.9, 0.99}
+
+// Return a short label for a session id that can be logged or exported without
+// revealing the id itself.
+func sessionLabel(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:4])
+}
+
+// A cumulative histogram. It is not safe for concurrent use by itself.
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) Observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Format a number the way Prometheus does.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeCounter(w io.Writer, name, help string, v uint64) {
+	writeHeader(w, name, "counter", help)
+	fmt.Fprintf(w, "%s %d\n", name, v)
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	writeHeader(w, name, "gauge", help)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogram) {
+	writeHeader(w, name, "histogram", help)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// ServerMetrics collects statistics from one or more Handlers. Use
+// NewServerMetrics to make one. A nil *ServerMetrics collects nothing.
+type ServerMetrics struct {
+	// If not nil, the limits of this RateLimit, and how long requests
+	// have waited for it, are reported too.
+	RateLimit *RateLimit
+
+	lock sync.Mutex
+
+	sessionsActive  int64
+	sessionsCreated uint64
+	sessionsExpired uint64
+	sessionsClosed  uint64
+	dialFailures    uint64
+	bytesUp         uint64
+	bytesDown       uint64
+	requests        map[int]uint64
+
+	// Sessions rejected by the total and per-client limits.
+	rejectedTotal     uint64
+	rejectedPerClient uint64
+
+	transactDuration *histogram
+	requestLength    *histogram
+	responseLength   *histogram
+}
+
+// NewServerMetrics returns a ServerMetrics with all counts at zero.
+func NewServerMetrics() *ServerMetrics {
+	return &ServerMetrics{
+		requests:         make(map[int]uint64),
+		transactDuration: newHistogram(durationBuckets),
+		requestLength:    newHistogram(payloadBuckets),
+		responseLength:   newHistogram(payloadBuckets),
+	}
+}
+
+func (m *ServerMetrics) sessionCreated() {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	m.sessionsCreated++
+	m.sessionsActive++
+	m.lock.Unlock()
+}
+
+// A session was removed, by expiring if expired is true and otherwise because
+// of an error or shutdown.
+func (m *ServerMetrics) sessionRemoved(expired bool) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	if expired {
+		m.sessionsExpired++
+	} else {
+		m.sessionsClosed++
+	}
+	m.sessionsActive--
+	m.lock.Unlock()
+}
+
+func (m *ServerMetrics) sessionRejected(perClient bool) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	if perClient {
+		m.rejectedPerClient++
+	} else {
+		m.rejectedTotal++
+	}
+	m.lock.Unlock()
+}
+
+func (m *ServerMetrics) dialFailed() {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	m.dialFailures++
+	m.lock.Unlock()
+}
+
+// Record a transaction that moved up bytes from the client and down bytes back
+// to it.
+func (m *ServerMetrics) transacted(up, down int64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	m.bytesUp += uint64(up)
+	m.bytesDown += uint64(down)
+	m.requestLength.Observe(float64(up))
+	m.responseLength.Observe(float64(down))
+	m.transactDuration.Observe(duration.Seconds())
+	m.lock.Unlock()
+}
+
+func (m *ServerMetrics) requestDone(status int) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	m.requests[status]++
+	m.lock.Unlock()
+}
+
+// WriteText writes the current statistics to w in the Prometheus text format.
+func (m *ServerMetrics) WriteText(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	writeGauge(w, "meek_server_sessions_active", "Sessions currently open.", float64(m.sessionsActive))
+	writeCounter(w, "meek_server_sessions_created_total", "Sessions opened.", m.sessionsCreated)
+	writeCounter(w, "meek_server_sessions_expired_total", "Sessions closed for lack of requests.", m.sessionsExpired)
+	writeCounter(w, "meek_server_sessions_closed_total", "Sessions closed because of an error or shutdown.", m.sessionsClosed)
+	writeHeader(w, "meek_server_sessions_rejected_total", "counter", "New sessions refused for being over a limit, by limit.")
+	fmt.Fprintf(w, "meek_server_sessions_rejected_total{limit=\"total\"} %d\n", m.rejectedTotal)
+	fmt.Fprintf(w, "meek_server_sessions_rejected_total{limit=\"per_client\"} %d\n", m.rejectedPerClient)
+	writeCounter(w, "meek_server_or_dial_failures_total", "Failed connections to the OR port.", m.dialFailures)
+	writeCounter(w, "meek_server_upstream_bytes_total", "Bytes received from clients and sent to the OR port.", m.bytesUp)
+	writeCounter(w, "meek_server_downstream_bytes_total", "Bytes read from the OR port and sent to clients.", m.bytesDown)
+
+	writeHeader(w, "meek_server_requests_total", "counter", "HTTP requests, by response status.")
+	var statuses []int
+	for status := range m.requests {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "meek_server_requests_total{status=\"%d\"} %d\n", status, m.requests[status])
+	}
+
+	if m.RateLimit != nil {
+		sessionRate, totalRate := m.RateLimit.Rates()
+		waitUp, waitDown := m.RateLimit.waited()
+		writeHeader(w, "meek_server_rate_limit_bytes_per_second", "gauge", "Bandwidth limit in each direction, for each session and for all together; 0 means none.")
+		fmt.Fprintf(w, "meek_server_rate_limit_bytes_per_second{scope=\"session\"} %d\n", sessionRate)
+		fmt.Fprintf(w, "meek_server_rate_limit_bytes_per_second{scope=\"total\"} %d\n", totalRate)
+		writeHeader(w, "meek_server_rate_limit_wait_seconds_total", "counter", "Time requests have waited because of bandwidth limits, by direction.")
+		fmt.Fprintf(w, "meek_server_rate_limit_wait_seconds_total{direction=\"upstream\"} %s\n", formatFloat(waitUp.Seconds()))
+		fmt.Fprintf(w, "meek_server_rate_limit_wait_seconds_total{direction=\"downstream\"} %s\n", formatFloat(waitDown.Seconds()))
+	}
+
+	writeHistogram(w, "meek_server_transact_duration_seconds", "Time spent moving data for one request, including waits for bandwidth limits.", m.transactDuration)
+	writeHistogram(w, "meek_server_request_payload_bytes", "Length of request bodies.", m.requestLength)
+	writeHistogram(w, "meek_server_response_payload_bytes", "Length of response bodies.", m.responseLength)
+}
+
+// ServeHTTP serves the statistics in the Prometheus text format.
+func (m *ServerMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
+
+// An http.ResponseWriter that remembers the status of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// The most recent roundtrip times, for computing percentiles.
+type rttWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+func (w *rttWindow) Add(rtt time.Duration) {
+	if len(w.samples) < rttWindowLength {
+		w.samples = append(w.samples, rtt)
+		return
+	}
+	w.samples[w.next] = rtt
+	w.next = (w.next + 1) % rttWindowLength
+}
+
+// Return the q-quantile (0 < q ≤ 1) of the samples by the nearest-rank method,
+// or 0 if there are none.
+func (w *rttWindow) Quantile(q float64) time.Duration {
+	if len(w.samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(w.samples))
+	copy(sorted, w.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// Counts for one session or one front.
+type clientStats struct {
+	requests  uint64
+	retries   uint64
+	bytesUp   uint64
+	bytesDown uint64
+	rttSum    time.Duration
+	rtt       rttWindow
+	// Only for sessions.
+	pollInterval time.Duration
+}
+
+// Return a one-line summary of stats, for the log.
+func (stats *clientStats) summary() string {
+	s := fmt.Sprintf("%d requests, %d retries, %d bytes up, %d bytes down", stats.requests, stats.retries, stats.bytesUp, stats.bytesDown)
+	if len(stats.rtt.samples) > 0 {
+		s += ", rtt"
+		for _, q := range rttQuantiles {
+			s += fmt.Sprintf(" p%s %.3fs", formatFloat(q*100), stats.rtt.Quantile(q).Seconds())
+		}
+	}
+	return s
+}
+
+// ClientMetrics collects statistics from one or more Dialers, for each open
+// session and for each front (the host that requests are sent to). Use
+// NewClientMetrics to make one. A nil *ClientMetrics collects nothing.
+type ClientMetrics struct {
+	lock sync.Mutex
+
+	sessionsTotal uint64
+	sessions      map[string]*clientStats
+	fronts        map[string]*clientStats
+}
+
+// NewClientMetrics returns a ClientMetrics with all counts at zero.
+func NewClientMetrics() *ClientMetrics {
+	return &ClientMetrics{
+		sessions: make(map[string]*clientStats),
+		fronts:   make(map[string]*clientStats),
+	}
+}
+
+func (m *ClientMetrics) sessionStarted(session string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	m.sessionsTotal++
+	m.sessions[session] = new(clientStats)
+	m.lock.Unlock()
+}
+
+// Forget a session. Its requests still count toward its front.
+func (m *ClientMetrics) sessionEnded(session string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	delete(m.sessions, session)
+	m.lock.Unlock()
+}
+
+// Return the stats for front, making them if necessary. Must be called with the
+// lock held.
+func (m *ClientMetrics) front(front string) *clientStats {
+	stats := m.fronts[front]
+	if stats == nil {
+		stats = new(clientStats)
+		m.fronts[front] = stats
+	}
+	return stats
+}
+
+// Record a completed request.
+func (m *ClientMetrics) requestDone(session, front string, sent, received int, rtt time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, stats := range []*clientStats{m.sessions[session], m.front(front)} {
+		if stats == nil {
+			continue
+		}
+		stats.requests++
+		stats.bytesUp += uint64(sent)
+		stats.bytesDown += uint64(received)
+		stats.rttSum += rtt
+		stats.rtt.Add(rtt)
+	}
+}
+
+// Record a retry of a request.
+func (m *ClientMetrics) retried(session, front string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if stats := m.sessions[session]; stats != nil {
+		stats.retries++
+	}
+	m.front(front).retries++
+}
+
+func (m *ClientMetrics) setPollInterval(session string, interval time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if stats := m.sessions[session]; stats != nil {
+		stats.pollInterval = interval
+	}
+}
+
+// Return the keys of a stats map in order.
+func sortedKeys(statsMap map[string]*clientStats) []string {
+	var keys []string
+	for key := range statsMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write the statistics in statsMap, labeled with label, as metrics whose names
+// start with prefix.
+func writeClientStats(w io.Writer, prefix, label string, statsMap map[string]*clientStats) {
+	keys := sortedKeys(statsMap)
+	counters := []struct {
+		name, help string
+		get        func(*clientStats) uint64
+	}{
+		{"requests_total", "Completed HTTP requests.", func(s *clientStats) uint64 { return s.requests }},
+		{"retries_total", "Retried HTTP requests.", func(s *clientStats) uint64 { return s.retries }},
+		{"upstream_bytes_total", "Bytes sent to the server.", func(s *clientStats) uint64 { return s.bytesUp }},
+		{"downstream_bytes_total", "Bytes received from the server.", func(s *clientStats) uint64 { return s.bytesDown }},
+	}
+	for _, c := range counters {
+		writeHeader(w, prefix+c.name, "counter", c.help+" By "+label+".")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s{%s=%s} %d\n", prefix, c.name, label, strconv.Quote(key), c.get(statsMap[key]))
+		}
+	}
+	name := prefix + "rtt_seconds"
+	writeHeader(w, name, "summary", "HTTP roundtrip time over the last "+strconv.Itoa(rttWindowLength)+" requests. By "+label+".")
+	for _, key := range keys {
+		stats := statsMap[key]
+		for _, q := range rttQuantiles {
+			fmt.Fprintf(w, "%s{%s=%s,quantile=\"%s\"} %s\n", name, label, strconv.Quote(key), formatFloat(q), formatFloat(stats.rtt.Quantile(q).Seconds()))
+		}
+		fmt.Fprintf(w, "%s_sum{%s=%s} %s\n", name, label, strconv.Quote(key), formatFloat(stats.rttSum.Seconds()))
+		fmt.Fprintf(w, "%s_count{%s=%s} %d\n", name, label, strconv.Quote(key), stats.requests)
+	}
+}
+
+// WriteText writes the current statistics to w in the Prometheus text format.
+// Sessions are labeled with a hash of their session id.
+func (m *ClientMetrics) WriteText(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	writeGauge(w, "meek_client_sessions_active", "Sessions currently open.", float64(len(m.sessions)))
+	writeCounter(w, "meek_client_sessions_total", "Sessions opened.", m.sessionsTotal)
+	writeClientStats(w, "meek_client_front_", "front", m.fronts)
+	writeClientStats(w, "meek_client_session_", "session", m.sessions)
+	name := "meek_client_session_poll_interval_seconds"
+	writeHeader(w, name, "gauge", "Current wait before polling an idle connection. By session.")
+	for _, key := range sortedKeys(m.sessions) {
+		fmt.Fprintf(w, "%s{session=%s} %s\n", name, strconv.Quote(key), formatFloat(m.sessions[key].pollInterval.Seconds()))
+	}
+}
+
+// ServeHTTP serves the statistics in the Prometheus text format.
+func (m *ClientMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
+
+// LogSummary calls logf with one line for each open session and each front,
+// summarizing its statistics.
+func (m *ClientMetrics) LogSummary(logf func(format string, v ...interface{})) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, key := range sortedKeys(m.sessions) {
+		stats := m.sessions[key]
+		logf("session %s: %s, poll interval %.3fs", key, stats.summary(), stats.pollInterval.Seconds())
+	}
+	for _, key := range sortedKeys(m.fronts) {
+		logf("front %s: %s", key, m.fronts[key].summary())
+	}
+}
+
+// ParseMetricsAddr parses the address of a metrics endpoint into a network and
+// address for net.Listen. It is either "unix:" followed by a path, or a TCP
+// host:port with a loopback host, so that the statistics aren't exposed to
+// anyone else.
+func ParseMetricsAddr(s string) (network, addr string, err error) {
+	if strings.HasPrefix(s, "unix:") {
+		return "unix", s[len("unix:"):], nil
+	}
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", "", err
+	}
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", "", errors.New(fmt.Sprintf("%s is not a loopback address", host))
+	}
+	return "tcp", s, nil
+}
+
+// ListenMetrics listens on the metrics endpoint address s (see
+// ParseMetricsAddr) and serves metrics at /metrics in the background until the
+// returned listener is closed. It logs the listening address, and any error in
+// serving, with logf.
+func ListenMetrics(s string, metrics http.Handler, logf func(format string, v ...interface{})) (net.Listener, error) {
+	network, addr, err := ParseMetricsAddr(s)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	logf("serving metrics on %s", ln.Addr())
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		err := http.Serve(ln, mux)
+		if err != nil {
+			logf("error in metrics Serve: %s", err)
+		}
+	}()
+	return ln, nil
+}
@@ -0,0 +1,217 @@
+package meek
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 10})
+	for _, v := range []float64{0.5, 1, 5, 100} {
+		h.Observe(v)
+	}
+	var buf bytes.Buffer
+	writeHistogram(&buf, "x", "Test.", h)
+	expected := `# HELP x Test.
+# TYPE x histogram
+x_bucket{le="1"} 2
+x_bucket{le="10"} 3
+x_bucket{le="+Inf"} 4
+x_sum 106.5
+x_count 4
+`
+	if buf.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	metrics := NewServerMetrics()
+	handler := NewHandler(DefaultServerConfig(), func(remoteAddr, target string) (net.Conn, error) {
+		if target == "fail:1" {
+			return nil, &net.AddrError{Err: "refused", Addr: target}
+		}
+		local, remote := newPipe(stringAddr(remoteAddr))
+		// The pipe is buffered, so this doesn't wait for a reader.
+		remote.Write([]byte("hello"))
+		return local, nil
+	})
+	handler.Metrics = metrics
+	handler.RateLimit = NewRateLimit(0, 1000000)
+	metrics.RateLimit = handler.RateLimit
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// One session that works and one whose dial fails.
+	for _, test := range []struct {
+		sessionID, target string
+	}{
+		{strings.Repeat("a", 32), ""},
+		{strings.Repeat("b", 32), "fail:1"},
+	} {
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader("abc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Session-Id", test.sessionID)
+		req.Header.Set("X-Session-Target", test.target)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	handler.Close()
+
+	var buf bytes.Buffer
+	metrics.WriteText(&buf)
+	for _, line := range []string{
+		"meek_server_sessions_active 0",
+		"meek_server_sessions_created_total 1",
+		"meek_server_sessions_closed_total 1",
+		"meek_server_or_dial_failures_total 1",
+		"meek_server_upstream_bytes_total 3",
+		"meek_server_downstream_bytes_total 5",
+		`meek_server_requests_total{status="200"} 1`,
+		`meek_server_requests_total{status="500"} 1`,
+		`meek_server_request_payload_bytes_bucket{le="64"} 1`,
+		`meek_server_response_payload_bytes_bucket{le="0"} 0`,
+		"meek_server_transact_duration_seconds_count 1",
+		`meek_server_rate_limit_bytes_per_second{scope="session"} 0`,
+		`meek_server_rate_limit_bytes_per_second{scope="total"} 1000000`,
+		`meek_server_rate_limit_wait_seconds_total{direction="upstream"} 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestRTTWindow(t *testing.T) {
+	var w rttWindow
+	if w.Quantile(0.5) != 0 {
+		t.Errorf("empty window: %s", w.Quantile(0.5))
+	}
+	// Fill the window twice over; only the second half should count.
+	for i := 1; i <= 2*rttWindowLength; i++ {
+		w.Add(time.Duration(i) * time.Millisecond)
+	}
+	for _, test := range []struct {
+		q        float64
+		expected time.Duration
+	}{
+		{0.01, (rttWindowLength + 1) * time.Millisecond},
+		{0.5, (rttWindowLength + rttWindowLength/2) * time.Millisecond},
+		{1, 2 * rttWindowLength * time.Millisecond},
+	} {
+		if w.Quantile(test.q) != test.expected {
+			t.Errorf("%v → %s (expected %s)", test.q, w.Quantile(test.q), test.expected)
+		}
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	server := httptest.NewServer(&echoServer{hosts: make(map[string]bool), sessions: make(map[string]bool)})
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := NewClientMetrics()
+	dialer := &Dialer{Paths: []Path{{URL: u}}, Tuning: DefaultTuning(), Metrics: metrics}
+	conn, err := dialer.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Metrics are recorded before the data is written back.
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text bytes.Buffer
+	metrics.WriteText(&text)
+	front := strconv.Quote(u.Host)
+	for _, line := range []string{
+		"meek_client_sessions_active 1",
+		"meek_client_sessions_total 1",
+		"meek_client_front_upstream_bytes_total{front=" + front + "} 5",
+		"meek_client_front_downstream_bytes_total{front=" + front + "} 5",
+	} {
+		if !strings.Contains(text.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, text.String())
+		}
+	}
+	if !strings.Contains(text.String(), "meek_client_session_poll_interval_seconds{session=") {
+		t.Errorf("missing session poll interval in\n%s", text.String())
+	}
+
+	var lines []string
+	metrics.LogSummary(func(format string, v ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, v...))
+	})
+	// Polls that carry no data may have happened since, so the number of
+	// requests isn't known exactly.
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "session ") || !strings.HasPrefix(lines[1], "front "+u.Host+": ") || !strings.Contains(lines[1], " 0 retries, 5 bytes up, 5 bytes down, rtt p50 ") {
+		t.Errorf("summary %q", lines)
+	}
+
+	conn.Close()
+}
+
+func TestParseMetricsAddr(t *testing.T) {
+	for _, input := range []string{"127.0.0.1:9100", "[::1]:9100", "localhost:9100", "unix:/run/metrics.sock"} {
+		_, _, err := ParseMetricsAddr(input)
+		if err != nil {
+			t.Errorf("%q: %s", input, err)
+		}
+	}
+	for _, input := range []string{"", "9100", "0.0.0.0:9100", "192.0.2.1:9100", "example.com:9100"} {
+		_, _, err := ParseMetricsAddr(input)
+		if err == nil {
+			t.Errorf("%q: unexpected success", input)
+		}
+	}
+}
+
+func TestListenMetrics(t *testing.T) {
+	m := NewServerMetrics()
+	ln, err := ListenMetrics("127.0.0.1:0", m, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	resp, err := http.Get("http://" + ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "meek_server_sessions_active 0") {
+		t.Errorf("unexpected metrics %q", body)
+	}
+
+	_, err = ListenMetrics("0.0.0.0:0", m, t.Logf)
+	if err == nil {
+		t.Errorf("non-loopback address unexpectedly succeeded")
+	}
+}
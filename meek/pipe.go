@@ -0,0 +1,174 @@
+package meek
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The code in this file is an in-memory connection like net.Pipe, but
+// buffered: a Write returns as soon as its data fits in the buffer, without
+// waiting for a Read at the other end. That matters because both the client
+// and the server write to their end of a pipe while the other side may itself
+// be blocked writing, which with net.Pipe would deadlock where a TCP
+// connection's socket buffers would not.
+
+// How many bytes may be buffered in each direction.
+const pipeBufferLength = 4 * maxPayloadLength
+
+// One direction of a pipe.
+type pipeBuffer struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+
+	readDeadline, writeDeadline time.Time
+	readTimer, writeTimer       *time.Timer
+}
+
+func newPipeBuffer() *pipeBuffer {
+	b := new(pipeBuffer)
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+func (b *pipeBuffer) Read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for b.buf.Len() == 0 {
+		if b.closed {
+			return 0, io.EOF
+		}
+		if !b.readDeadline.IsZero() && !time.Now().Before(b.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+	n, _ := b.buf.Read(p)
+	b.cond.Broadcast()
+	return n, nil
+}
+
+func (b *pipeBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	total := 0
+	for len(p) > 0 {
+		if b.closed {
+			return total, io.ErrClosedPipe
+		}
+		if !b.writeDeadline.IsZero() && !time.Now().Before(b.writeDeadline) {
+			return total, os.ErrDeadlineExceeded
+		}
+		space := pipeBufferLength - b.buf.Len()
+		if space <= 0 {
+			b.cond.Wait()
+			continue
+		}
+		if space > len(p) {
+			space = len(p)
+		}
+		b.buf.Write(p[:space])
+		p = p[space:]
+		total += space
+		b.cond.Broadcast()
+	}
+	return total, nil
+}
+
+// Close the buffer. Data already written can still be read, after which Read
+// returns io.EOF.
+func (b *pipeBuffer) Close() {
+	b.lock.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.lock.Unlock()
+}
+
+// Set a deadline, arranging to wake up waiters when it passes.
+func (b *pipeBuffer) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	*deadline = t
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			b.lock.Lock()
+			b.cond.Broadcast()
+			b.lock.Unlock()
+		})
+	}
+	b.cond.Broadcast()
+}
+
+// One end of a pipe.
+type pipeConn struct {
+	r, w       *pipeBuffer
+	remoteAddr net.Addr
+}
+
+// Return the two ends of a new pipe. remoteAddr is what the second end reports
+// as its RemoteAddr.
+func newPipe(remoteAddr net.Addr) (net.Conn, net.Conn) {
+	a, b := newPipeBuffer(), newPipeBuffer()
+	return &pipeConn{r: a, w: b, remoteAddr: stringAddr("meek")},
+		&pipeConn{r: b, w: a, remoteAddr: remoteAddr}
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// Close both directions. The other end can still read what was written before
+// Close.
+func (c *pipeConn) Close() error {
+	c.r.Close()
+	c.w.Close()
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return stringAddr("meek")
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.r.setDeadline(&c.r.readDeadline, &c.r.readTimer, t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.w.setDeadline(&c.w.writeDeadline, &c.w.writeTimer, t)
+	return nil
+}
+
+// A net.Addr for addresses that are only known as strings.
+type stringAddr string
+
+func (addr stringAddr) Network() string {
+	return "meek"
+}
+
+func (addr stringAddr) String() string {
+	return string(addr)
+}
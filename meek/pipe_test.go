@@ -0,0 +1,49 @@
+package meek
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := newPipe(stringAddr("client"))
+	if b.RemoteAddr().String() != "client" {
+		t.Errorf("RemoteAddr %v", b.RemoteAddr())
+	}
+
+	// Writes up to the buffer length do not wait for a reader.
+	data := bytes.Repeat([]byte("x"), pipeBufferLength)
+	n, err := a.Write(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("Write: %d %v", n, err)
+	}
+
+	// But a write past it does, until the deadline.
+	a.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = a.Write([]byte("y"))
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		t.Errorf("Write on full pipe: %v", err)
+	}
+
+	// A read deadline on an empty pipe times out.
+	a.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = a.Read(make([]byte, 1))
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		t.Errorf("Read on empty pipe: %v", err)
+	}
+
+	// Data written before Close can still be read, then EOF.
+	a.Close()
+	buf, err := ioutil.ReadAll(b)
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Errorf("ReadAll after Close: %d bytes, %v", len(buf), err)
+	}
+	_, err = b.Write([]byte("z"))
+	if err != io.ErrClosedPipe {
+		t.Errorf("Write after Close: %v", err)
+	}
+}
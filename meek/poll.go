@@ -0,0 +1,146 @@
+package meek
+
+import (
+	"fmt"
+	"time"
+)
+
+// The code in this file decides how long to wait before polling the server when
+// there is nothing to send. It adapts to the measured roundtrip time and to
+// the recent traffic pattern, which is one of:
+//
+// bulk: a large transfer is under way (requests or responses are carrying at
+// least bulkPayloadLength bytes, or throughput is at least bulkRate). Poll
+// immediately and keep every path busy.
+//
+// active: some data is flowing, but not much; for example an interactive
+// session. Poll immediately, but only when nothing else is in flight.
+//
+// idle: the last request moved no data. The target time between the start of
+// one poll and the start of the next begins at the initial poll interval and
+// grows geometrically up to the maximum. Because a poll itself takes about one
+// roundtrip, the wait after a poll completes is the target less the smoothed
+// roundtrip time; on a slow path that means polling again sooner.
+
+const (
+	// A request or response at least this big indicates a bulk transfer.
+	bulkPayloadLength = maxPayloadLength / 2
+	// Throughput in bytes per second that indicates a bulk transfer.
+	bulkRate = 64 * 1024
+	// Gains for the exponentially weighted moving averages of roundtrip
+	// time and throughput.
+	rttGain  = 1.0 / 8
+	rateGain = 1.0 / 4
+)
+
+type pollMode int
+
+const (
+	pollIdle pollMode = iota
+	pollActive
+	pollBulk
+)
+
+func (mode pollMode) String() string {
+	switch mode {
+	case pollIdle:
+		return "idle"
+	case pollActive:
+		return "active"
+	case pollBulk:
+		return "bulk"
+	}
+	return fmt.Sprintf("pollMode(%d)", int(mode))
+}
+
+// A pollScheduler tracks completed requests and decides when to poll next. It
+// is not safe for concurrent use.
+type pollScheduler struct {
+	tuning *Tuning
+	// Returns the current time; replaceable for testing.
+	now func() time.Time
+	// Logs debugging messages, if not nil.
+	debugf func(format string, v ...interface{})
+
+	mode pollMode
+	// Target time between the starts of consecutive idle polls.
+	target time.Duration
+	// Smoothed roundtrip time; 0 until the first sample.
+	srtt time.Duration
+	// Smoothed throughput in bytes per second, both directions together.
+	rate float64
+	// Time of the previous call to Completed.
+	last time.Time
+}
+
+func newPollScheduler(tuning *Tuning, now func() time.Time) *pollScheduler {
+	return &pollScheduler{
+		tuning: tuning,
+		now:    now,
+		mode:   pollIdle,
+		target: tuning.InitPollInterval,
+		last:   now(),
+	}
+}
+
+// Record the completion of a request that sent sent bytes, received received
+// bytes, and took rtt, not counting retries and rate limit waits.
+func (s *pollScheduler) Completed(sent, received int, rtt time.Duration) {
+	now := s.now()
+
+	if s.srtt == 0 {
+		s.srtt = rtt
+	} else {
+		s.srtt += time.Duration(rttGain * float64(rtt-s.srtt))
+	}
+
+	// Throughput over the time since the last completion, which with
+	// several paths may be less than one roundtrip.
+	elapsed := now.Sub(s.last)
+	if elapsed < time.Millisecond {
+		elapsed = time.Millisecond
+	}
+	sample := float64(sent+received) / elapsed.Seconds()
+	s.rate += rateGain * (sample - s.rate)
+	s.last = now
+
+	switch {
+	case sent >= bulkPayloadLength || received >= bulkPayloadLength || (sent+received > 0 && s.rate >= bulkRate):
+		s.mode = pollBulk
+	case sent+received > 0:
+		s.mode = pollActive
+	case s.mode != pollIdle:
+		// The first time we don't send or receive anything, wait a
+		// while.
+		s.mode = pollIdle
+		s.target = s.tuning.InitPollInterval
+	default:
+		// After that, wait a little longer.
+		s.target = time.Duration(float64(s.target) * s.tuning.PollIntervalMultiplier)
+		if s.target > s.tuning.MaxPollInterval {
+			s.target = s.tuning.MaxPollInterval
+		}
+	}
+
+	if s.debugf != nil {
+		s.debugf("poll: sent %d received %d rtt %s; srtt %s rate %.0f B/s; mode %s interval %s",
+			sent, received, rtt, s.srtt, s.rate, s.mode, s.Interval())
+	}
+}
+
+// How long to wait for data to send before polling anyway.
+func (s *pollScheduler) Interval() time.Duration {
+	if s.mode != pollIdle {
+		return 0
+	}
+	interval := s.target - s.srtt
+	if interval < 0 {
+		interval = 0
+	}
+	return interval
+}
+
+// Whether a poll may be sent while other requests are in flight.
+func (s *pollScheduler) Parallel() bool {
+	return s.mode == pollBulk
+}
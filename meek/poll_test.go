@@ -0,0 +1,123 @@
+package meek
+
+import (
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestPollSchedulerIdle(t *testing.T) {
+	tuning := DefaultTuning()
+	clock := &fakeClock{time.Unix(0, 0)}
+	s := newPollScheduler(&tuning, clock.Now)
+
+	if s.Interval() != tuning.InitPollInterval || s.Parallel() {
+		t.Fatalf("initial interval %s parallel %v", s.Interval(), s.Parallel())
+	}
+
+	// Some interactive traffic: poll immediately, one at a time.
+	clock.Advance(50 * time.Millisecond)
+	s.Completed(100, 0, 50*time.Millisecond)
+	if s.mode != pollActive || s.Interval() != 0 || s.Parallel() {
+		t.Fatalf("after data: mode %s interval %s parallel %v", s.mode, s.Interval(), s.Parallel())
+	}
+
+	// Then nothing: the target grows geometrically up to the maximum,
+	// with the wait shortened by the roundtrip time.
+	target := tuning.InitPollInterval
+	for i := 0; i < 20; i++ {
+		clock.Advance(s.Interval() + 50*time.Millisecond)
+		s.Completed(0, 0, 50*time.Millisecond)
+		if s.mode != pollIdle {
+			t.Fatalf("poll %d: mode %s", i, s.mode)
+		}
+		expected := target - s.srtt
+		if s.Interval() != expected {
+			t.Fatalf("poll %d: interval %s (expected %s)", i, s.Interval(), expected)
+		}
+		target = time.Duration(float64(target) * tuning.PollIntervalMultiplier)
+		if target > tuning.MaxPollInterval {
+			target = tuning.MaxPollInterval
+		}
+	}
+	if s.Interval() != tuning.MaxPollInterval-s.srtt {
+		t.Errorf("interval %s did not reach maximum", s.Interval())
+	}
+}
+
+func TestPollSchedulerRTT(t *testing.T) {
+	tuning := DefaultTuning()
+	clock := &fakeClock{time.Unix(0, 0)}
+	s := newPollScheduler(&tuning, clock.Now)
+
+	// On a path slower than the initial poll interval, idle polls go out
+	// as soon as the previous one returns.
+	for i := 0; i < 3; i++ {
+		clock.Advance(time.Second)
+		s.Completed(0, 0, time.Second)
+	}
+	if s.srtt != time.Second {
+		t.Errorf("srtt %s", s.srtt)
+	}
+	if s.Interval() != 0 {
+		t.Errorf("interval %s (expected 0)", s.Interval())
+	}
+
+	// The smoothed RTT moves gradually.
+	clock.Advance(200 * time.Millisecond)
+	s.Completed(0, 0, 200*time.Millisecond)
+	if s.srtt != 900*time.Millisecond {
+		t.Errorf("srtt %s (expected 900ms)", s.srtt)
+	}
+}
+
+func TestPollSchedulerBulk(t *testing.T) {
+	tuning := DefaultTuning()
+	clock := &fakeClock{time.Unix(0, 0)}
+	s := newPollScheduler(&tuning, clock.Now)
+
+	// A full response means a bulk transfer.
+	clock.Advance(100 * time.Millisecond)
+	s.Completed(0, maxPayloadLength, 100*time.Millisecond)
+	if s.mode != pollBulk || s.Interval() != 0 || !s.Parallel() {
+		t.Fatalf("after full response: mode %s interval %s parallel %v", s.mode, s.Interval(), s.Parallel())
+	}
+
+	// Small responses arriving quickly keep the rate high enough to stay in
+	// bulk mode.
+	for i := 0; i < 5; i++ {
+		clock.Advance(10 * time.Millisecond)
+		s.Completed(0, 4000, 10*time.Millisecond)
+		if s.mode != pollBulk {
+			t.Fatalf("small response %d: mode %s rate %.0f", i, s.mode, s.rate)
+		}
+	}
+
+	// Small responses arriving slowly let the rate decay to active.
+	for i := 0; i < 20; i++ {
+		clock.Advance(time.Second)
+		s.Completed(10, 10, 100*time.Millisecond)
+	}
+	if s.mode != pollActive || s.Parallel() {
+		t.Errorf("after slow responses: mode %s rate %.0f", s.mode, s.rate)
+	}
+
+	// An empty poll switches to idle at the initial target.
+	clock.Advance(100 * time.Millisecond)
+	s.Completed(0, 0, 100*time.Millisecond)
+	if s.mode != pollIdle || s.target != tuning.InitPollInterval {
+		t.Errorf("after empty poll: mode %s target %s", s.mode, s.target)
+	}
+}
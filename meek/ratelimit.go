@@ -0,0 +1,234 @@
+package meek
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// The code in this file has to do with bandwidth limits on the server. A
+// RateLimit, shared by any number of Handlers, sets a rate in bytes per second
+// for each session and a rate for all sessions together, each applying to the
+// upstream and downstream directions separately. Limits work by token buckets
+// that may go into debt: a request moves its data at once, and then waits
+// before responding until the buckets have paid off the debt, which delays the
+// client's next request.
+//
+// For fairness, the wait is taken a chunk at a time, reserving from the buckets
+// only one chunk ahead. A session with a lot of data to move therefore can't
+// reserve the whole of the shared bucket in advance; sessions that are waiting
+// take turns, and one with only a little data gets through after a few chunks
+// of the others.
+//
+// Waits must not keep a response from being written within the HTTP server's
+// write timeout (ServerConfig.WriteTimeout). Every wait ends by a deadline,
+// rateLimitWaitFraction of the write timeout after the request arrived; an
+// upstream debt that isn't paid off by then carries over to later requests.
+// Downstream, a request reads from the OR port only as much as it can pay for
+// by the deadline, so that a session short of tokens gets a smaller response,
+// or an empty one, rather than a late one.
+
+// How many bytes to reserve from the buckets at a time.
+const rateLimitChunk = 4096
+
+// The fraction of the write timeout after which rate limit waits end, leaving
+// the rest for writing the response.
+const rateLimitWaitFraction = 0.75
+
+// The smallest nonzero rate. Slower rates would make a response with a full
+// payload wait longer than an HTTP server's usual write timeout.
+const MinRate = 16384
+
+// A token bucket that holds up to one second's worth of tokens. A rate of 0
+// means no limit.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) burst() float64 {
+	if b.rate < rateLimitChunk {
+		return rateLimitChunk
+	}
+	return b.rate
+}
+
+// Change the rate. Must be called with the lock held.
+func (b *tokenBucket) setRate(rate int) {
+	if float64(rate) == b.rate {
+		return
+	}
+	b.rate = float64(rate)
+	if b.tokens > b.burst() {
+		b.tokens = b.burst()
+	}
+}
+
+// Take n tokens at time now, at the given rate, and return how long to wait
+// until the bucket is out of debt.
+func (b *tokenBucket) reserve(rate int, n int, now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.setRate(rate)
+	if b.rate <= 0 {
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = b.burst()
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst() {
+			b.tokens = b.burst()
+		}
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Return how many tokens the bucket will have at time then, if none are taken
+// from now until then, at the given rate; negative if it will still be in debt.
+// Returns +Inf if there is no limit.
+func (b *tokenBucket) available(rate int, now, then time.Time) float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.setRate(rate)
+	if b.rate <= 0 {
+		return math.Inf(1)
+	}
+	tokens := b.burst()
+	if !b.last.IsZero() {
+		tokens = b.tokens + now.Sub(b.last).Seconds()*b.rate
+		if tokens > b.burst() {
+			tokens = b.burst()
+		}
+	}
+	if then.After(now) {
+		tokens += then.Sub(now).Seconds() * b.rate
+	}
+	return tokens
+}
+
+// RateLimit holds bandwidth limits, and the buckets for the total of all
+// sessions. Use NewRateLimit to make one. A nil *RateLimit limits nothing.
+type RateLimit struct {
+	lock        sync.Mutex
+	sessionRate int
+	totalRate   int
+	// Time spent waiting, for statistics.
+	waitUp, waitDown time.Duration
+
+	totalUp, totalDown tokenBucket
+}
+
+// NewRateLimit returns a RateLimit with the given rates in bytes per second per
+// direction, for each session and for all sessions together. A rate of 0 means
+// no limit.
+func NewRateLimit(sessionRate, totalRate int) *RateLimit {
+	l := new(RateLimit)
+	l.Set(sessionRate, totalRate)
+	return l
+}
+
+// Set changes the rates. It takes effect for requests already waiting.
+func (l *RateLimit) Set(sessionRate, totalRate int) {
+	l.lock.Lock()
+	l.sessionRate = sessionRate
+	l.totalRate = totalRate
+	l.lock.Unlock()
+}
+
+// Rates returns the current rates.
+func (l *RateLimit) Rates() (sessionRate, totalRate int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.sessionRate, l.totalRate
+}
+
+// Return the total time spent waiting in each direction.
+func (l *RateLimit) waited() (up, down time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.waitUp, l.waitDown
+}
+
+// Return the deadline for rate limit waits of a request that arrived at start.
+// The zero time means no deadline.
+func (handler *Handler) waitDeadline(start time.Time) time.Time {
+	if handler.config.WriteTimeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(time.Duration(float64(handler.config.WriteTimeout) * rateLimitWaitFraction))
+}
+
+// Return how many bytes, up to max, session can send downstream and pay for by
+// deadline.
+func (l *RateLimit) allowance(session *Session, max int, deadline time.Time) int {
+	if l == nil || deadline.IsZero() {
+		return max
+	}
+	sessionRate, totalRate := l.Rates()
+	now := time.Now()
+	n := math.Min(session.downBucket.available(sessionRate, now, deadline), l.totalDown.available(totalRate, now, deadline))
+	if n <= 0 {
+		return 0
+	}
+	if n < float64(max) {
+		return int(n)
+	}
+	return max
+}
+
+// Wait until n bytes moved in one direction (upstream if up is true) by session
+// are paid for, or until deadline if it is not zero. Whatever is not paid for
+// by the deadline remains a debt of the buckets.
+func (l *RateLimit) wait(session *Session, up bool, n int, deadline time.Time) {
+	if l == nil {
+		return
+	}
+	sessionRate, totalRate := l.Rates()
+	if sessionRate <= 0 && totalRate <= 0 {
+		return
+	}
+	sessionBucket, totalBucket := &session.downBucket, &l.totalDown
+	if up {
+		sessionBucket, totalBucket = &session.upBucket, &l.totalUp
+	}
+	var waited time.Duration
+	for n > 0 {
+		c := n
+		if c > rateLimitChunk {
+			c = rateLimitChunk
+		}
+		now := time.Now()
+		if !deadline.IsZero() && !now.Before(deadline) {
+			// Out of time: take the rest as debt.
+			c = n
+		}
+		delay := sessionBucket.reserve(sessionRate, c, now)
+		if d := totalBucket.reserve(totalRate, c, now); d > delay {
+			delay = d
+		}
+		if !deadline.IsZero() && now.Add(delay).After(deadline) {
+			delay = deadline.Sub(now)
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+			waited += delay
+		}
+		n -= c
+	}
+
+	l.lock.Lock()
+	if up {
+		l.waitUp += waited
+	} else {
+		l.waitDown += waited
+	}
+	l.lock.Unlock()
+}
@@ -0,0 +1,189 @@
+package meek
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	now := time.Unix(1000, 0)
+
+	// No limit.
+	if d := b.reserve(0, 1000000, now); d != 0 {
+		t.Errorf("no limit → %s", d)
+	}
+
+	// A new bucket starts full, with one second's worth.
+	if d := b.reserve(20000, 20000, now); d != 0 {
+		t.Errorf("burst → %s", d)
+	}
+	// Going into debt.
+	if d := b.reserve(20000, 10000, now); d != 500*time.Millisecond {
+		t.Errorf("debt → %s (expected %s)", d, 500*time.Millisecond)
+	}
+	// Paying off the debt.
+	now = now.Add(250 * time.Millisecond)
+	if d := b.reserve(20000, 0, now); d != 250*time.Millisecond {
+		t.Errorf("partly paid → %s (expected %s)", d, 250*time.Millisecond)
+	}
+	// Tokens don't accumulate past the burst.
+	now = now.Add(time.Hour)
+	if d := b.reserve(20000, 30000, now); d != 500*time.Millisecond {
+		t.Errorf("after idle → %s (expected %s)", d, 500*time.Millisecond)
+	}
+	// Lowering the rate lowers the burst.
+	now = now.Add(time.Hour)
+	if d := b.reserve(10000, 15000, now); d != 500*time.Millisecond {
+		t.Errorf("lower rate → %s (expected %s)", d, 500*time.Millisecond)
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	var session Session
+
+	// A nil RateLimit doesn't wait.
+	var l *RateLimit
+	start := time.Now()
+	l.wait(&session, true, 1000000, time.Time{})
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("nil RateLimit waited %s", elapsed)
+	}
+
+	l = NewRateLimit(MinRate, 0)
+	start = time.Now()
+	l.wait(&session, false, MinRate+MinRate/4, time.Time{})
+	elapsed := time.Since(start)
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("waited %s (expected about %s)", elapsed, 250*time.Millisecond)
+	}
+	waitUp, waitDown := l.waited()
+	if waitUp != 0 || waitDown < 200*time.Millisecond {
+		t.Errorf("waitUp=%s waitDown=%s", waitUp, waitDown)
+	}
+
+	// The other direction has its own bucket.
+	start = time.Now()
+	l.wait(&session, true, MinRate, time.Time{})
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("upstream waited %s", elapsed)
+	}
+
+	// Setting no limit takes effect at once.
+	l.Set(0, 0)
+	start = time.Now()
+	l.wait(&session, false, 10*MinRate, time.Time{})
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("after Set(0, 0) waited %s", elapsed)
+	}
+}
+
+// A session moving a little data isn't held up behind one moving a lot under
+// the total limit.
+func TestRateLimitFairness(t *testing.T) {
+	var bulk, small Session
+	l := NewRateLimit(0, MinRate)
+
+	var wg sync.WaitGroup
+	var bulkDone, smallDone time.Time
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		l.wait(&bulk, false, 2*MinRate, time.Time{})
+		bulkDone = time.Now()
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(100 * time.Millisecond)
+		l.wait(&small, false, rateLimitChunk, time.Time{})
+		smallDone = time.Now()
+	}()
+	wg.Wait()
+	if !smallDone.Before(bulkDone) {
+		t.Errorf("small session finished %s after bulk session", smallDone.Sub(bulkDone))
+	}
+}
+
+// Waits end by the deadline, leaving the rest as debt, and the debt shrinks
+// what can be sent next.
+func TestRateLimitDeadline(t *testing.T) {
+	var session Session
+	l := NewRateLimit(MinRate, 0)
+
+	// A new bucket has one second's worth, and gains another second's
+	// worth by a deadline a second away.
+	if n := l.allowance(&session, 0x10000, time.Now().Add(time.Second)); n < MinRate || n > 2*MinRate {
+		t.Errorf("allowance %d (expected about %d)", n, 2*MinRate)
+	}
+	if n := l.allowance(&session, 1000, time.Now().Add(time.Second)); n != 1000 {
+		t.Errorf("allowance %d (expected the maximum %d)", n, 1000)
+	}
+	if n := l.allowance(&session, 1000, time.Time{}); n != 1000 {
+		t.Errorf("allowance with no deadline %d (expected %d)", n, 1000)
+	}
+
+	start := time.Now()
+	l.wait(&session, false, 10*MinRate, start.Add(200*time.Millisecond))
+	elapsed := time.Since(start)
+	if elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("waited %s (expected about %s)", elapsed, 200*time.Millisecond)
+	}
+	if n := l.allowance(&session, 0x10000, time.Now().Add(time.Second)); n != 0 {
+		t.Errorf("allowance in debt %d (expected 0)", n)
+	}
+
+	// A nil RateLimit allows the maximum.
+	l = nil
+	if n := l.allowance(&session, 1000, time.Now()); n != 1000 {
+		t.Errorf("nil RateLimit allowance %d", n)
+	}
+}
+
+// A session short of tokens gets a smaller response, in time to be written
+// before the write timeout.
+func TestHandlerRateLimitPayload(t *testing.T) {
+	config := DefaultServerConfig()
+	config.WriteTimeout = time.Second
+	config.TurnaroundTimeout = 100 * time.Millisecond
+	remotes := make(chan net.Conn, 1)
+	handler := NewHandler(config, func(remoteAddr, target string) (net.Conn, error) {
+		local, remote := newPipe(stringAddr(remoteAddr))
+		remotes <- remote
+		return local, nil
+	})
+	defer handler.Close()
+	handler.RateLimit = NewRateLimit(MinRate, 0)
+
+	post := func() int {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(""))
+		req.Header.Set("X-Session-Id", strings.Repeat("a", 32))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+		return w.Body.Len()
+	}
+
+	// Open the session and fill the OR port with more than can be sent
+	// within the deadline.
+	post()
+	remote := <-remotes
+	defer remote.Close()
+	go remote.Write(make([]byte, 4*config.MaxPayloadLength))
+
+	start := time.Now()
+	n := post()
+	elapsed := time.Since(start)
+	if n == 0 || n >= config.MaxPayloadLength {
+		t.Errorf("response of %d bytes", n)
+	}
+	if elapsed > config.WriteTimeout {
+		t.Errorf("response took %s, longer than the write timeout", elapsed)
+	}
+}
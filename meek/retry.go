@@ -0,0 +1,193 @@
+package meek
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The code in this file decides which failed HTTP roundtrips are worth trying
+// again, and how long to wait before doing so.
+//
+// Transient failures (DNS errors, refused or reset connections, TLS handshake
+// failures, timeouts, 5xx statuses, and 429 Too Many Requests) are retried.
+// Other failures, in particular certificate errors and 4xx statuses, are not:
+// they will not go away by themselves, and trying again only delays reporting
+// them. A network error is retried only if the request can't have been sent,
+// because the connection to the front failed. That goes for numbered requests
+// too: the server closes a session on seeing a sequence number again.
+//
+// The wait before the nth retry is chosen at random between half of and all of
+// RetryDelay * 2^(n-1), capped at MaxRetryDelay. A Retry-After header field
+// in a 429 or 5xx response overrides the wait if it asks for longer. No retry
+// is attempted if its wait would end after RetryDeadline has passed since the
+// first try.
+
+type errorClass int
+
+const (
+	errorOther errorClass = iota
+	errorDNS
+	errorRefused
+	errorReset
+	errorTLS
+	errorCertificate
+	errorTimeout
+	errorServer
+	errorTooManyRequests
+	errorStatus
+)
+
+func (class errorClass) String() string {
+	switch class {
+	case errorOther:
+		return "other"
+	case errorDNS:
+		return "DNS"
+	case errorRefused:
+		return "connection refused"
+	case errorReset:
+		return "connection reset"
+	case errorTLS:
+		return "TLS"
+	case errorCertificate:
+		return "certificate"
+	case errorTimeout:
+		return "timeout"
+	case errorServer:
+		return "server error"
+	case errorTooManyRequests:
+		return "too many requests"
+	case errorStatus:
+		return "status"
+	}
+	return fmt.Sprintf("errorClass(%d)", int(class))
+}
+
+// Whether a failure of this class is worth trying again.
+func (class errorClass) Retryable() bool {
+	switch class {
+	case errorDNS, errorRefused, errorReset, errorTLS, errorTimeout, errorServer, errorTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// Classify an error returned by a roundtrip.
+func classifyError(err error) errorClass {
+	var dnsErr *net.DNSError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalidErr x509.CertificateInvalidError
+	var pinErr *PinError
+	var echErr *tls.ECHRejectionError
+	var recordHeaderErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return errorDNS
+	case errors.As(err, &unknownAuthorityErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &certInvalidErr),
+		errors.As(err, &pinErr),
+		errors.As(err, &echErr):
+		return errorCertificate
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorRefused
+	case errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE):
+		return errorReset
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errorTimeout
+	case errors.As(err, &recordHeaderErr),
+		errors.As(err, &alertErr),
+		strings.HasPrefix(err.Error(), "tls: "):
+		return errorTLS
+	}
+	return errorOther
+}
+
+// An error from a roundtrip that failed before the connection to the front was
+// established, so that none of the request can have reached the server.
+type unsentError struct {
+	err error
+}
+
+func (err *unsentError) Error() string {
+	return err.err.Error()
+}
+
+func (err *unsentError) Unwrap() error {
+	return err.err
+}
+
+// Whether a roundtrip that failed with err may be tried again without risk of
+// the server seeing the same data twice, because the request provably wasn't
+// sent.
+func safeToRetry(err error) bool {
+	var unsentErr *unsentError
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &unsentErr), errors.As(err, &dnsErr):
+		return true
+	case errors.As(err, &opErr):
+		return opErr.Op == "dial" || opErr.Op == "proxyconnect"
+	}
+	return false
+}
+
+// Classify an HTTP status other than 200.
+func classifyStatus(code int) errorClass {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return errorTooManyRequests
+	case code >= 500 && code < 600:
+		return errorServer
+	}
+	return errorStatus
+}
+
+// Parse the value of a Retry-After header field, which is either a number of
+// seconds or an HTTP date. ok is false if the value is missing or malformed.
+func parseRetryAfter(value string, now time.Time) (delay time.Duration, ok bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	seconds, err := strconv.ParseUint(value, 10, 32)
+	if err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	delay = t.Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
+
+// How long to wait before retry number retry (counting from 1), given a
+// random number r in [0, 1).
+func backoffDelay(tuning *Tuning, retry int, r float64) time.Duration {
+	delay := tuning.RetryDelay
+	for i := 1; i < retry && delay < tuning.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > tuning.MaxRetryDelay {
+		delay = tuning.MaxRetryDelay
+	}
+	return delay/2 + time.Duration(r*float64(delay/2))
+}
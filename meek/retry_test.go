@@ -0,0 +1,136 @@
+package meek
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected errorClass
+	}{
+		{&net.DNSError{Err: "no such host", Name: "example.com"}, errorDNS},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, errorRefused},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, errorReset},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, errorTimeout},
+		{errors.New("tls: handshake failure"), errorTLS},
+		{x509.UnknownAuthorityError{}, errorCertificate},
+		{&PinError{}, errorCertificate},
+		{errors.New("helper returned error: something"), errorOther},
+	}
+	for _, test := range tests {
+		class := classifyError(test.err)
+		if class != test.expected {
+			t.Errorf("%q → %s (expected %s)", test.err, class, test.expected)
+		}
+		if class.Retryable() != (test.expected != errorCertificate && test.expected != errorOther) {
+			t.Errorf("%q: Retryable is %v", test.err, class.Retryable())
+		}
+	}
+}
+
+func TestSafeToRetry(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{&net.DNSError{Err: "no such host", Name: "example.com"}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, true},
+		{&unsentError{errors.New("tls: handshake failure")}, true},
+		{&unsentError{reset}, true},
+		// The request may have been sent.
+		{reset, false},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, false},
+		{errors.New("tls: bad record MAC"), false},
+	}
+	for _, test := range tests {
+		safe := safeToRetry(test.err)
+		if safe != test.expected {
+			t.Errorf("%q → %v (expected %v)", test.err, safe, test.expected)
+		}
+	}
+}
+
+func TestClassifyStatus(t *testing.T) {
+	tests := []struct {
+		code      int
+		expected  errorClass
+		retryable bool
+	}{
+		{http.StatusTooManyRequests, errorTooManyRequests, true},
+		{http.StatusInternalServerError, errorServer, true},
+		{http.StatusBadGateway, errorServer, true},
+		{http.StatusServiceUnavailable, errorServer, true},
+		{http.StatusBadRequest, errorStatus, false},
+		{http.StatusForbidden, errorStatus, false},
+		{http.StatusNotFound, errorStatus, false},
+	}
+	for _, test := range tests {
+		class := classifyStatus(test.code)
+		if class != test.expected || class.Retryable() != test.retryable {
+			t.Errorf("%d → %s, %v (expected %s, %v)", test.code, class, class.Retryable(), test.expected, test.retryable)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, time.October, 21, 7, 28, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"120", 120 * time.Second, true},
+		{" 0 ", 0, true},
+		{"Wed, 21 Oct 2015 07:28:30 GMT", 30 * time.Second, true},
+		{"Wed, 21 Oct 2015 07:27:00 GMT", 0, true},
+		{"-1", 0, false},
+		{"1.5", 0, false},
+		{"soon", 0, false},
+	}
+	for _, test := range tests {
+		delay, ok := parseRetryAfter(test.value, now)
+		if delay != test.expected || ok != test.ok {
+			t.Errorf("%q → %s, %v (expected %s, %v)", test.value, delay, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	tuning := DefaultTuning()
+	tuning.RetryDelay = 1 * time.Second
+	tuning.MaxRetryDelay = 10 * time.Second
+	tests := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 500 * time.Millisecond, 1 * time.Second},
+		{2, 1 * time.Second, 2 * time.Second},
+		{3, 2 * time.Second, 4 * time.Second},
+		{4, 4 * time.Second, 8 * time.Second},
+		{5, 5 * time.Second, 10 * time.Second},
+		{100, 5 * time.Second, 10 * time.Second},
+	}
+	for _, test := range tests {
+		low := backoffDelay(&tuning, test.retry, 0.0)
+		high := backoffDelay(&tuning, test.retry, 0.999999)
+		if low != test.min || high < test.max-time.Millisecond || high > test.max {
+			t.Errorf("retry %d: [%s, %s] (expected [%s, %s])", test.retry, low, high, test.min, test.max)
+		}
+	}
+
+	tuning.RetryDelay = 0
+	if delay := backoffDelay(&tuning, 5, 0.5); delay != 0 {
+		t.Errorf("retry-delay 0: %s", delay)
+	}
+}
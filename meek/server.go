@@ -0,0 +1,613 @@
+package meek
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The code in this file is the server side of the transport. A Handler is an
+// http.Handler that keeps track of session ids and connects each session to a
+// net.Conn made by its DialFunc; it can be mounted in any Go web server. A
+// Listener is a Handler whose sessions are instead returned by Accept, so that
+// an application can terminate meek itself:
+// 	ln := meek.NewListener(meek.DefaultServerConfig())
+// 	go http.Serve(tcpListener, ln)
+// 	for {
+// 		conn, err := ln.Accept()
+// 		...
+// 	}
+
+const (
+	// Reject session ids shorter than this, as a weak defense against
+	// client bugs that send an empty session id or something similarly
+	// likely to collide.
+	minSessionIdLength = 32
+	// How long we try to read something back from the OR port before
+	// returning the response.
+	turnaroundTimeout = 10 * time.Millisecond
+	// Cull unused session ids (with their corresponding OR port connection)
+	// if we haven't seen any activity for this long.
+	maxSessionStaleness = 120 * time.Second
+	// How long a request with an X-Session-Seq header waits for the
+	// requests before it to be processed. This should be longer than a
+	// client could reasonably take to send them over its other paths, but
+	// shorter than a server's write timeout (meek-server's is 20 s), so that
+	// the waiting request can still get a response.
+	maxSeqWait = 15 * time.Second
+	// The write timeout assumed for the HTTP server, the same as
+	// meek-server's.
+	writeTimeout = 20 * time.Second
+)
+
+// ServerConfig holds the tunable parameters of a Handler.
+type ServerConfig struct {
+	// The largest request body to accept, and the largest response body to
+	// send. Clients don't accept more than 65536 bytes.
+	MaxPayloadLength int
+	// How long to wait for data from the OR port before responding.
+	TurnaroundTimeout time.Duration
+	// How long a session lasts without a request.
+	MaxSessionStaleness time.Duration
+	// How long a multipath request waits for its turn.
+	MaxSeqWait time.Duration
+	// The write timeout of the HTTP server. Rate limit waits end early
+	// enough for the response to be written before it; see ratelimit.go.
+	// 0 means no limit on waits.
+	WriteTimeout time.Duration
+	// The most sessions that may be open at once, and the most that may
+	// be open from one client; 0 means no limit. See limits.go.
+	MaxSessions          int
+	MaxSessionsPerClient int
+}
+
+// DefaultServerConfig returns the default server parameters.
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		MaxPayloadLength:    maxPayloadLength,
+		TurnaroundTimeout:   turnaroundTimeout,
+		MaxSessionStaleness: maxSessionStaleness,
+		MaxSeqWait:          maxSeqWait,
+		WriteTimeout:        writeTimeout,
+	}
+}
+
+// A DialFunc makes the "OR port" connection for a new session, given the
+// address of the client (the remote address of its HTTP request, or what a
+// trusted proxy says it is; see forwarded.go), and the destination the client
+// asked for in an X-Session-Target header (empty if there was none). It is up
+// to the DialFunc whether to honor or ignore the target. A DialFunc that
+// refuses a target by policy should return a *RefusedError, so that the client
+// gets a 403 response, which it doesn't retry, rather than a 500.
+type DialFunc func(remoteAddr, target string) (net.Conn, error)
+
+// The error a DialFunc returns when it refuses to make a connection, as opposed
+// to failing to make one.
+type RefusedError struct {
+	Err error
+}
+
+func (err *RefusedError) Error() string {
+	return err.Err.Error()
+}
+
+func httpBadRequest(w http.ResponseWriter) {
+	http.Error(w, "Bad request.\n", http.StatusBadRequest)
+}
+
+func httpForbidden(w http.ResponseWriter) {
+	http.Error(w, "Forbidden.\n", http.StatusForbidden)
+}
+
+func httpInternalServerError(w http.ResponseWriter) {
+	http.Error(w, "Internal server error.\n", http.StatusInternalServerError)
+}
+
+// Every session id maps to an existing OR port connection, which we keep open
+// between received requests. The first time we see a new session id, we create
+// a new OR port connection.
+type Session struct {
+	Or       net.Conn
+	LastSeen time.Time
+	Created  time.Time
+
+	// The key of the client that opened the session; see limits.go.
+	client string
+
+	// Per-session bandwidth limits; see ratelimit.go.
+	upBucket, downBucket tokenBucket
+
+	// Accounting for the summary at the end of the session; see
+	// accounting.go.
+	requests  uint64
+	bytesUp   uint64
+	bytesDown uint64
+	countLock sync.Mutex
+
+	// For requests carrying X-Session-Seq: the sequence number of the
+	// next request to be processed, and whether a numbered request is being
+	// processed right now.
+	nextSeq uint64
+	inTurn  bool
+	seqLock sync.Mutex
+	seqCond *sync.Cond
+}
+
+func NewSession(or net.Conn) *Session {
+	session := &Session{Or: or, Created: time.Now()}
+	session.seqCond = sync.NewCond(&session.seqLock)
+	return session
+}
+
+// Mark a session as having been seen just now.
+func (session *Session) Touch() {
+	session.LastSeen = time.Now()
+}
+
+// Is this session old enough to be culled?
+func (session *Session) IsExpired(maxStaleness time.Duration) bool {
+	return time.Since(session.LastSeen) > maxStaleness
+}
+
+// Block until it is the turn of the request with sequence number seq; that is,
+// until all the requests numbered before it have been processed. Returns an
+// error if seq was already processed, or if the turn doesn't come within
+// timeout. After a nil return, the caller must call EndTurn.
+func (session *Session) WaitTurn(seq uint64, timeout time.Duration) error {
+	// Wake ourselves up when the time is up.
+	timer := time.AfterFunc(timeout, func() {
+		session.seqLock.Lock()
+		session.seqCond.Broadcast()
+		session.seqLock.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	session.seqLock.Lock()
+	defer session.seqLock.Unlock()
+	for session.inTurn || session.nextSeq != seq {
+		if seq < session.nextSeq {
+			return errors.New(fmt.Sprintf("duplicate sequence number %d", seq))
+		}
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("timed out waiting for sequence number %d (at %d)", seq, session.nextSeq))
+		}
+		session.seqCond.Wait()
+	}
+	session.inTurn = true
+	return nil
+}
+
+// Let the request after the current one take its turn.
+func (session *Session) EndTurn() {
+	session.seqLock.Lock()
+	session.inTurn = false
+	session.nextSeq++
+	session.seqCond.Broadcast()
+	session.seqLock.Unlock()
+}
+
+// A Handler is the HTTP side of a meek server. Use NewHandler to make one.
+type Handler struct {
+	// If not nil, called to log errors.
+	Logf func(format string, v ...interface{})
+	// If not nil, receives statistics. It may be shared by several
+	// Handlers.
+	Metrics *ServerMetrics
+	// If not nil, called with a summary of each session when it is
+	// removed. It is called without the Handler's lock held, so it may
+	// be slow without holding up requests, but it may be called from
+	// several goroutines at once.
+	SessionEnded func(summary *SessionSummary)
+	// If not nil, limits the bandwidth of sessions. It may be shared by
+	// several Handlers, which then share its total limit.
+	RateLimit *RateLimit
+	// Requests from these addresses may give the address of the client
+	// they are forwarding for in a header field; see forwarded.go.
+	TrustedProxies []*net.IPNet
+	// The header field that trusted proxies put the client address in. If
+	// empty, Forwarded and X-Forwarded-For are used.
+	ClientAddrHeader string
+
+	sessionMap map[string]*Session
+	pending    map[string]*pendingSession
+	lock       sync.Mutex
+	config     ServerConfig
+	dial       DialFunc
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	// The number of open sessions for each client key, and the number of
+	// sessions rejected by admit since the last logRejections.
+	clientSessions    map[string]int
+	rejectedTotal     int
+	rejectedPerClient int
+}
+
+// NewHandler returns a Handler that calls dial to make the connection for each
+// new session. Call Close to stop expiring sessions when the Handler is no
+// longer needed.
+func NewHandler(config ServerConfig, dial DialFunc) *Handler {
+	handler := new(Handler)
+	handler.sessionMap = make(map[string]*Session)
+	handler.pending = make(map[string]*pendingSession)
+	handler.clientSessions = make(map[string]int)
+	handler.config = config
+	handler.dial = dial
+	handler.done = make(chan struct{})
+	go handler.ExpireSessions()
+	return handler
+}
+
+func (handler *Handler) logf(format string, v ...interface{}) {
+	if handler.Logf != nil {
+		handler.Logf(format, v...)
+	}
+}
+
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if handler.Metrics != nil {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+			handler.Metrics.requestDone(sw.status)
+		}()
+		w = sw
+	}
+	switch req.Method {
+	case "GET":
+		handler.Get(w, req)
+	case "POST":
+		handler.Post(w, req)
+	default:
+		httpBadRequest(w)
+	}
+}
+
+// Handle a GET request. This doesn't have any purpose apart from diagnostics.
+func (handler *Handler) Get(w http.ResponseWriter, req *http.Request) {
+	if path.Clean(req.URL.Path) != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("I’m just a happy little web server.\n"))
+}
+
+// A session whose OR port connection is still being dialed. Requests for the
+// same session id that arrive in the meantime wait for done, then use session,
+// or fail with err.
+type pendingSession struct {
+	done    chan struct{}
+	session *Session
+	err     error
+}
+
+// Look up a session by id, or create a new one (with its OR port connection) if
+// it doesn't already exist. Returns a *limitError if a new session would be over
+// one of the limits. The connection is dialed without the lock held, so that a
+// slow dial holds up only the requests of its own session.
+func (handler *Handler) GetSession(sessionId string, req *http.Request) (*Session, error) {
+	handler.lock.Lock()
+	session := handler.sessionMap[sessionId]
+	if session != nil {
+		session.Touch()
+		handler.lock.Unlock()
+		return session, nil
+	}
+	if p := handler.pending[sessionId]; p != nil {
+		handler.lock.Unlock()
+		<-p.done
+		return p.session, p.err
+	}
+
+	// log.Printf("unknown session id %q; creating new session", sessionId)
+	remoteAddr := handler.clientAddr(req)
+	client := clientKey(remoteAddr)
+	err := handler.admit(client)
+	if err != nil {
+		handler.lock.Unlock()
+		return nil, err
+	}
+	// Hold the session's place against the limits while dialing.
+	p := &pendingSession{done: make(chan struct{})}
+	handler.pending[sessionId] = p
+	handler.clientSessions[client]++
+	handler.lock.Unlock()
+
+	or, err := handler.dial(remoteAddr, req.Header.Get("X-Session-Target"))
+
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	delete(handler.pending, sessionId)
+	if err == nil {
+		select {
+		case <-handler.done:
+			or.Close()
+			err = errors.New("handler is closed")
+		default:
+		}
+	}
+	if err != nil {
+		handler.releaseClient(client)
+		switch err.(type) {
+		case *RefusedError, *limitError:
+		default:
+			handler.Metrics.dialFailed()
+		}
+		p.err = err
+		close(p.done)
+		return nil, err
+	}
+	session = NewSession(or)
+	session.client = client
+	session.Touch()
+	handler.sessionMap[sessionId] = session
+	handler.Metrics.sessionCreated()
+	p.session = session
+	close(p.done)
+
+	return session, nil
+}
+
+// Feed the body of req into the OR port, and write any data read from the OR
+// port back to w, waiting as needed to stay within the rate limits, but not past
+// waitDeadline.
+func (handler *Handler) transact(session *Session, w http.ResponseWriter, req *http.Request, waitDeadline time.Time) error {
+	config := &handler.config
+	start := time.Now()
+	body := http.MaxBytesReader(w, req.Body, int64(config.MaxPayloadLength)+1)
+	up, err := io.Copy(session.Or, body)
+	if err != nil {
+		return errors.New(fmt.Sprintf("copying body to ORPort: %s", err))
+	}
+	handler.RateLimit.wait(session, true, int(up), waitDeadline)
+
+	// Read no more than can be paid for by waitDeadline.
+	buf := make([]byte, handler.RateLimit.allowance(session, config.MaxPayloadLength, waitDeadline))
+	var n int
+	if len(buf) > 0 {
+		session.Or.SetReadDeadline(time.Now().Add(config.TurnaroundTimeout))
+		n, err = session.Or.Read(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				httpInternalServerError(w)
+				return errors.New(fmt.Sprintf("reading from ORPort: %s", err))
+			}
+		}
+	}
+	// log.Printf("read %d bytes from ORPort: %q", n, buf[:n])
+	handler.RateLimit.wait(session, false, n, waitDeadline)
+	// Set a Content-Type to prevent Go and the CDN from trying to guess.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	n, err = w.Write(buf[:n])
+	session.count(up, int64(n))
+	handler.Metrics.transacted(up, int64(n), time.Since(start))
+	if err != nil {
+		return errors.New(fmt.Sprintf("writing to response: %s", err))
+	}
+	// log.Printf("wrote %d bytes to response", n)
+	return nil
+}
+
+// Handle a POST request. Look up the session id and then do a transaction.
+func (handler *Handler) Post(w http.ResponseWriter, req *http.Request) {
+	waitDeadline := handler.waitDeadline(time.Now())
+	sessionId := req.Header.Get("X-Session-Id")
+	if len(sessionId) < minSessionIdLength {
+		httpBadRequest(w)
+		return
+	}
+
+	var seq uint64
+	seqStr := req.Header.Get("X-Session-Seq")
+	if seqStr != "" {
+		var err error
+		seq, err = strconv.ParseUint(seqStr, 10, 64)
+		if err != nil {
+			httpBadRequest(w)
+			return
+		}
+	}
+
+	session, err := handler.GetSession(sessionId, req)
+	if _, ok := err.(*limitError); ok {
+		// Not logged here; see logRejections.
+		httpServiceUnavailable(w, overLimitRetryAfter)
+		return
+	}
+	if _, ok := err.(*RefusedError); ok {
+		handler.logf("%s", err)
+		httpForbidden(w)
+		return
+	}
+	if err != nil {
+		handler.logf("%s", err)
+		httpInternalServerError(w)
+		return
+	}
+
+	if seqStr != "" {
+		err = session.WaitTurn(seq, handler.config.MaxSeqWait)
+		if err != nil {
+			handler.logf("%s", err)
+			httpBadRequest(w)
+			handler.CloseSession(sessionId, CloseSequenceError)
+			return
+		}
+		defer session.EndTurn()
+	}
+
+	err = handler.transact(session, w, req, waitDeadline)
+	if err != nil {
+		handler.logf("%s", err)
+		handler.CloseSession(sessionId, CloseError)
+		return
+	}
+}
+
+// Remove a session from the map and closes its corresponding OR port
+// connection, giving reason in its summary. Does nothing if the session id is
+// not known.
+func (handler *Handler) CloseSession(sessionId, reason string) {
+	handler.lock.Lock()
+	// log.Printf("closing session %q", sessionId)
+	var summaries []*SessionSummary
+	session, ok := handler.sessionMap[sessionId]
+	if ok {
+		summaries = append(summaries, handler.removeSession(sessionId, session, reason))
+	}
+	handler.lock.Unlock()
+	handler.sessionsEnded(summaries)
+}
+
+// Close a session's OR port connection, remove it from the map, and account
+// for it. Returns the session's summary, for sessionsEnded. Must be called with
+// the lock held.
+func (handler *Handler) removeSession(sessionId string, session *Session, reason string) *SessionSummary {
+	session.Or.Close()
+	delete(handler.sessionMap, sessionId)
+	handler.releaseClient(session.client)
+	handler.Metrics.sessionRemoved(reason == CloseExpired)
+	return session.summary(sessionId, reason, time.Now())
+}
+
+// Pass the summaries of removed sessions to SessionEnded. Must be called
+// without the lock held.
+func (handler *Handler) sessionsEnded(summaries []*SessionSummary) {
+	if handler.SessionEnded == nil {
+		return
+	}
+	for _, summary := range summaries {
+		handler.SessionEnded(summary)
+	}
+}
+
+// Loop until Close is called, checking for expired sessions and removing them,
+// and logging any sessions rejected for being over a limit.
+func (handler *Handler) ExpireSessions() {
+	for {
+		select {
+		case <-time.After(handler.config.MaxSessionStaleness / 2):
+		case <-handler.done:
+			return
+		}
+		var summaries []*SessionSummary
+		handler.lock.Lock()
+		for sessionId, session := range handler.sessionMap {
+			if session.IsExpired(handler.config.MaxSessionStaleness) {
+				// log.Printf("deleting expired session %q", sessionId)
+				summaries = append(summaries, handler.removeSession(sessionId, session, CloseExpired))
+			}
+		}
+		handler.logRejections()
+		handler.lock.Unlock()
+		handler.sessionsEnded(summaries)
+	}
+}
+
+// Close all sessions and stop expiring them.
+func (handler *Handler) Close() error {
+	handler.closeOnce.Do(func() {
+		close(handler.done)
+	})
+	var summaries []*SessionSummary
+	handler.lock.Lock()
+	for sessionId, session := range handler.sessionMap {
+		summaries = append(summaries, handler.removeSession(sessionId, session, CloseShutdown))
+	}
+	handler.lock.Unlock()
+	handler.sessionsEnded(summaries)
+	return nil
+}
+
+// A Listener is an http.Handler whose sessions are returned by Accept, one
+// net.Conn per session. Use NewListener to make one. New sessions that Accept
+// falls too far behind on are refused with a 503. Closing a Listener closes all
+// its sessions.
+type Listener struct {
+	*Handler
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// How many new sessions may be waiting for Accept before more are refused.
+const listenerBacklog = 64
+
+// NewListener returns a Listener with the given parameters. It does not listen
+// on the network by itself; serve HTTP requests with it, for example with
+// http.Serve, to get sessions.
+func NewListener(config ServerConfig) *Listener {
+	ln := &Listener{
+		conns: make(chan net.Conn, listenerBacklog),
+		done:  make(chan struct{}),
+	}
+	ln.Handler = NewHandler(config, ln.dial)
+	return ln
+}
+
+// The DialFunc of a Listener: hand one end of a pipe to Accept. The target is
+// ignored. If the backlog is full, because the program isn't calling Accept
+// fast enough, the session is refused with a *limitError rather than made to
+// wait.
+func (ln *Listener) dial(remoteAddr, target string) (net.Conn, error) {
+	select {
+	case <-ln.done:
+		return nil, errors.New("listener is closed")
+	default:
+	}
+	local, remote := newPipe(makeAddr(remoteAddr))
+	select {
+	case ln.conns <- remote:
+		return local, nil
+	default:
+		local.Close()
+		return nil, &limitError{backlog: true}
+	}
+}
+
+// Accept waits for and returns the connection of the next new session.
+func (ln *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.done:
+		return nil, errors.New("listener is closed")
+	}
+}
+
+// Close stops accepting new sessions and closes existing ones.
+func (ln *Listener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.done)
+	})
+	return ln.Handler.Close()
+}
+
+// Addr returns a placeholder address, since a Listener is not bound to one.
+func (ln *Listener) Addr() net.Addr {
+	return stringAddr("meek")
+}
+
+// Parse a request's RemoteAddr into a *net.TCPAddr if possible.
+func makeAddr(s string) net.Addr {
+	host, portStr, err := net.SplitHostPort(s)
+	if err == nil {
+		ip := net.ParseIP(host)
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if ip != nil && err == nil {
+			return &net.TCPAddr{IP: ip, Port: int(port)}
+		}
+	}
+	return stringAddr(s)
+}
@@ -0,0 +1,307 @@
+package meek
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run a Listener behind an HTTP server, and return it and a Dialer for it with
+// numPaths paths.
+func startListener(t *testing.T, numPaths int) (*Listener, *httptest.Server, *Dialer) {
+	config := DefaultServerConfig()
+	config.TurnaroundTimeout = 50 * time.Millisecond
+	// Requests left waiting for their turn when a client goes away hold up
+	// server.Close for this long.
+	config.MaxSeqWait = 1 * time.Second
+	ln := NewListener(config)
+	server := httptest.NewServer(ln)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &Dialer{Tuning: DefaultTuning()}
+	dialer.Tuning.InitPollInterval = 10 * time.Millisecond
+	for i := 0; i < numPaths; i++ {
+		dialer.Paths = append(dialer.Paths, Path{URL: u})
+	}
+	return ln, server, dialer
+}
+
+func TestListener(t *testing.T) {
+	for _, numPaths := range []int{1, 4} {
+		ln, server, dialer := startListener(t, numPaths)
+
+		// Echo every session.
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				if _, ok := conn.RemoteAddr().(*net.TCPAddr); !ok {
+					t.Errorf("RemoteAddr %v is not a *net.TCPAddr", conn.RemoteAddr())
+				}
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+
+		for i := 0; i < 2; i++ {
+			conn, err := dialer.Dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Enough data to take several requests, so that with
+			// multiple paths they are in flight at once.
+			data := bytes.Repeat([]byte(strings.Repeat("x", 99)+"\n"), 3000)
+			go func() {
+				conn.Write(data)
+			}()
+			buf := make([]byte, len(data))
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			_, err = io.ReadFull(conn, buf)
+			if err != nil {
+				t.Fatalf("%d paths: %s", numPaths, err)
+			}
+			if !bytes.Equal(buf, data) {
+				t.Errorf("%d paths: data came back different", numPaths)
+			}
+			conn.Close()
+		}
+
+		ln.Close()
+		server.Close()
+		_, err := ln.Accept()
+		if err == nil {
+			t.Errorf("Accept after Close succeeded")
+		}
+	}
+}
+
+func TestHandlerBadRequests(t *testing.T) {
+	ln, server, _ := startListener(t, 1)
+	defer server.Close()
+	defer ln.Close()
+
+	tests := []struct {
+		method, sessionID, seq string
+		expected               int
+	}{
+		{"GET", "", "", http.StatusOK},
+		{"PUT", strings.Repeat("a", 32), "", http.StatusBadRequest},
+		{"POST", "", "", http.StatusBadRequest},
+		{"POST", "short", "", http.StatusBadRequest},
+		{"POST", strings.Repeat("a", 32), "x", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.sessionID != "" {
+			req.Header.Set("X-Session-Id", test.sessionID)
+		}
+		if test.seq != "" {
+			req.Header.Set("X-Session-Seq", test.seq)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.expected {
+			t.Errorf("%s %q %q: status %d (expected %d)", test.method, test.sessionID, test.seq, resp.StatusCode, test.expected)
+		}
+	}
+}
+
+func TestHandlerTarget(t *testing.T) {
+	targets := make(chan string, 1)
+	handler := NewHandler(DefaultServerConfig(), func(remoteAddr, target string) (net.Conn, error) {
+		targets <- target
+		local, _ := newPipe(stringAddr(remoteAddr))
+		return local, nil
+	})
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer := &Dialer{Paths: []Path{{URL: u}}, Tuning: DefaultTuning(), Target: "db.internal:5432"}
+	conn, err := dialer.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case target := <-targets:
+		if target != dialer.Target {
+			t.Errorf("target %q (expected %q)", target, dialer.Target)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session was opened")
+	}
+}
+
+// A slow dial for one session doesn't hold up requests for other sessions, and
+// requests for the session being dialed wait for it.
+func TestHandlerSlowDial(t *testing.T) {
+	release := make(chan struct{})
+	handler := NewHandler(DefaultServerConfig(), func(remoteAddr, target string) (net.Conn, error) {
+		if target == "slow" {
+			<-release
+		}
+		local, _ := newPipe(stringAddr(remoteAddr))
+		return local, nil
+	})
+	defer handler.Close()
+
+	post := func(sessionID, target string) int {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(""))
+		req.Header.Set("X-Session-Id", strings.Repeat(sessionID, 32))
+		req.Header.Set("X-Session-Target", target)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	slow := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			slow <- post("a", "slow")
+		}()
+	}
+	done := make(chan int)
+	go func() {
+		done <- post("b", "fast")
+	}()
+	select {
+	case status := <-done:
+		if status != http.StatusOK {
+			t.Errorf("fast session: status %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fast session was held up by slow dial")
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		status := <-slow
+		if status != http.StatusOK {
+			t.Errorf("slow session: status %d", status)
+		}
+	}
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if len(handler.sessionMap) != 2 || len(handler.pending) != 0 {
+		t.Errorf("%d sessions and %d pending (expected 2 and 0)", len(handler.sessionMap), len(handler.pending))
+	}
+}
+
+// A refused target gets a 403, and a failed dial a 500.
+func TestHandlerRefused(t *testing.T) {
+	handler := NewHandler(DefaultServerConfig(), func(remoteAddr, target string) (net.Conn, error) {
+		if target == "refused" {
+			return nil, &RefusedError{Err: errors.New("not allowed")}
+		}
+		return nil, errors.New("connection refused")
+	})
+	defer handler.Close()
+
+	tests := []struct {
+		target   string
+		expected int
+	}{
+		{"refused", http.StatusForbidden},
+		{"failed", http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(""))
+		req.Header.Set("X-Session-Id", strings.Repeat("a", 32))
+		req.Header.Set("X-Session-Target", test.target)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		status := w.Result().StatusCode
+		if status != test.expected {
+			t.Errorf("%q: status %d (expected %d)", test.target, status, test.expected)
+		}
+		if classifyStatus(status).Retryable() != (test.expected != http.StatusForbidden) {
+			t.Errorf("%q: status %d has the wrong retryability", test.target, status)
+		}
+	}
+}
+
+// Sessions beyond the backlog of a Listener that isn't accepting get a 503
+// instead of waiting.
+func TestListenerBacklog(t *testing.T) {
+	ln := NewListener(DefaultServerConfig())
+	defer ln.Close()
+
+	post := func(sessionID string) *http.Response {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(""))
+		req.Header.Set("X-Session-Id", sessionID)
+		w := httptest.NewRecorder()
+		ln.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	for i := 0; i < listenerBacklog; i++ {
+		resp := post(fmt.Sprintf("%032d", i))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("session %d: status %d", i, resp.StatusCode)
+		}
+	}
+	resp := post(fmt.Sprintf("%032d", listenerBacklog))
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("over backlog: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// Accepting a session makes room for another.
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	resp = post(fmt.Sprintf("%032d", listenerBacklog+1))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("after Accept: status %d", resp.StatusCode)
+	}
+}
+
+// Close may be called more than once, from several goroutines.
+func TestListenerCloseTwice(t *testing.T) {
+	ln := NewListener(DefaultServerConfig())
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- ln.Close()
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	_, err := ln.Accept()
+	if err == nil {
+		t.Error("Accept after Close succeeded")
+	}
+}
@@ -0,0 +1,42 @@
+package meek
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+)
+
+// The code in this file has to do with public key pinning of the front's
+// certificate. A pin is the SHA-256 digest of a certificate's DER-encoded
+// SubjectPublicKeyInfo, as in HTTP Public Key Pinning.
+
+// CertPin returns the pin of a certificate.
+func CertPin(cert *x509.Certificate) [sha256.Size]byte {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// VerifyPins returns a function suitable for tls.Config.VerifyPeerCertificate
+// that accepts only if some certificate in some verified chain matches one of
+// pins. On failure the function returns a *PinError.
+func VerifyPins(pins [][sha256.Size]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				p := CertPin(cert)
+				for _, pin := range pins {
+					if p == pin {
+						return nil
+					}
+				}
+			}
+		}
+		return &PinError{}
+	}
+}
+
+// PinError is the error returned when no certificate matches a pin. It has its
+// own type so that it is not mistaken for a transient failure and retried.
+type PinError struct{}
+
+func (err *PinError) Error() string {
+	return "no certificate in the front's chain matches a pinned public key"
+}
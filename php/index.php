@@ -10,6 +10,12 @@
 	if ( array_key_exists("HTTP_X_SESSION_ID", $_SERVER) ) {
 		$headerArray[] = "X-Session-Id: " . $_SERVER["HTTP_X_SESSION_ID"];
 	}
+	if ( array_key_exists("HTTP_X_SESSION_SEQ", $_SERVER) ) {
+		$headerArray[] = "X-Session-Seq: " . $_SERVER["HTTP_X_SESSION_SEQ"];
+	}
+	if ( array_key_exists("HTTP_X_SESSION_TARGET", $_SERVER) ) {
+		$headerArray[] = "X-Session-Target: " . $_SERVER["HTTP_X_SESSION_TARGET"];
+	}
 
 	function HeaderFunc( $ch, $header ) {
 		if ( explode( ":", $header )[0] == "Content-Type" ) {